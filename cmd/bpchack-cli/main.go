@@ -13,9 +13,11 @@ import (
 	"github.com/pkg/errors"
 
 	"ykjam/bpchack/pkg"
+	"ykjam/bpchack/pkg/redact"
 )
 
 func run() error {
+	redact.Install()
 	log.Info("Starting BPC Hack CLI")
 	complete := false
 
@@ -27,6 +29,7 @@ func run() error {
 	var step2Response pkg.SubmitCardResponse
 	var step3Response pkg.ResendCodeResponse
 	var step4Response pkg.ConfirmPaymentResponse
+	var step5Response pkg.OrderStatusResponse
 	err = godotenv.Load()
 	if err != nil {
 		log.WithError(err).Error("error loading .env, ignoring")
@@ -69,7 +72,10 @@ mainLoop:
 			}
 			complete = true
 		}
-		service = pkg.NewService(mpiBaseUrl, 30*time.Second)
+		service = pkg.NewService([]pkg.BankProfile{{
+			Name:       "cli",
+			BaseMpiUrl: mpiBaseUrl,
+		}}, pkg.WithTimeout(30*time.Second))
 		log.Info("service initialized")
 
 		fmt.Print("payment url > ")
@@ -91,7 +97,7 @@ mainLoop:
 		}
 
 		step1Response, err = service.Step1StartHack(ctx, step1Request)
-		if err != nil {
+		if err != nil && !pkg.IsBankAnswer(err) {
 			eMsg := "error executing step1 start hack, restarting"
 			log.WithError(err).Error(eMsg)
 			complete = false
@@ -100,7 +106,7 @@ mainLoop:
 		fmt.Printf("response: %v\n\n", step1Response)
 
 		if cardNumber != "" {
-			fmt.Printf("Card Number [%s] > ", cardNumber)
+			fmt.Printf("Card Number [%s] > ", redact.PAN(cardNumber))
 		} else {
 			fmt.Print("Card Number > ")
 		}
@@ -160,7 +166,7 @@ mainLoop:
 		step2Request := pkg.SubmitCardRequest{
 			Application: application,
 			Identity:    identity,
-			MDOrder:     step1Response.MDOrder,
+			Token:       step1Response.Token,
 			CardNumber:  cardNumber,
 			Expiry:      cardExpiry,
 			NameOnCard:  nameOnCard,
@@ -168,7 +174,7 @@ mainLoop:
 		}
 
 		step2Response, err = service.Step2SubmitCard(ctx, step2Request)
-		if err != nil {
+		if err != nil && !pkg.IsBankAnswer(err) {
 			eMsg := "error executing step2 submit card, restarting"
 			log.WithError(err).Error(eMsg)
 			complete = false
@@ -208,13 +214,12 @@ mainLoop:
 				fmt.Print("resending code")
 				// resend code here
 				step3Request := pkg.ResendCodeRequest{
-					Application:   application,
-					Identity:      identity,
-					ACSRequestId:  step2Response.ACSRequestId,
-					ACSSessionUrl: step2Response.ACSSessionUrl,
+					Application: application,
+					Identity:    identity,
+					Token:       step1Response.Token,
 				}
 				step3Response, err = service.Step3ResendCode(ctx, step3Request)
-				if err != nil {
+				if err != nil && !pkg.IsBankAnswer(err) {
 					eMsg := "error executing step3 resend code, restarting"
 					log.WithError(err).Error(eMsg)
 					complete = false
@@ -253,21 +258,31 @@ mainLoop:
 		step4Request := pkg.ConfirmPaymentRequest{
 			Application:     application,
 			Identity:        identity,
-			MDOrder:         step1Response.MDOrder,
-			ACSRequestId:    step2Response.ACSRequestId,
-			ACSSessionUrl:   step2Response.ACSSessionUrl,
+			Token:           step1Response.Token,
 			OneTimePassword: input,
-			TerminateUrl:    step2Response.TerminateUrl,
 		}
 		step4Response, err = service.Step4ConfirmPayment(ctx, step4Request)
-		if err != nil {
+		if err != nil && !pkg.IsBankAnswer(err) {
 			eMsg := "error executing step4 confirm payment, restarting"
 			log.WithError(err).Error(eMsg)
 			complete = false
 			continue mainLoop
 		}
 		fmt.Printf("response: %v\n", step4Response)
-
+		if step4Response.Status != pkg.HackResponseStatusOk {
+			continue
+		}
+		// confirmed payment is not necessarily deposited
+		step5Response, err = service.Step5OrderStatus(ctx, pkg.OrderStatusRequest{
+			Application: application,
+			Identity:    identity,
+			Token:       step1Response.Token,
+		})
+		if err != nil && !pkg.IsBankAnswer(err) {
+			log.WithError(err).Error("error executing step5 order status")
+			continue
+		}
+		fmt.Printf("response: %v\n", step5Response)
 	}
 	return nil
 }
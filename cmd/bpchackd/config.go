@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+
+	"ykjam/bpchack/pkg"
+	"ykjam/bpchack/pkg/web"
+)
+
+type config struct {
+	ListenAddress string `json:"listen_address"`
+	// single bank setup, ignored when banks are given
+	BaseMpiUrl   string             `json:"base_mpi_url,omitempty"`
+	Banks        []bankConfig       `json:"banks,omitempty"`
+	SessionStore sessionStoreConfig `json:"session_store"`
+	// enables debug endpoints exposing session state, never enable in production
+	Debug bool `json:"debug,omitempty"`
+	// enables admin endpoints exposing state of service, they are served only at admin listen address
+	Admin bool `json:"admin,omitempty"`
+	// address of listener of metrics and admin endpoints, keep it in internal network
+	AdminListenAddress string        `json:"admin_listen_address,omitempty"`
+	HTTP               httpConfig    `json:"http"`
+	Tracing            tracingConfig `json:"tracing"`
+	// applications allowed to call workflow endpoints, anyone can call them if empty
+	Applications []applicationConfig `json:"applications,omitempty"`
+	// limits of workflow endpoints by step name, limits of one-time password steps per order if omitted
+	RateLimits map[pkg.Step]endpointLimitConfig `json:"rate_limits,omitempty"`
+	// overrides default validation rules of request fields
+	Validation validationConfig `json:"validation,omitempty"`
+	// path to catalogue of bank error phrases, builtin catalogue is used if empty
+	BankErrorsCatalogue string `json:"bank_errors_catalogue,omitempty"`
+}
+
+// checkAdmin verifies metrics and admin endpoints never end up on public listener
+func (c *config) checkAdmin() error {
+	if c.AdminListenAddress == "" {
+		if c.Admin {
+			return errors.New("admin endpoints require admin_listen_address")
+		}
+		return nil
+	}
+	if c.AdminListenAddress == c.ListenAddress {
+		return errors.New("admin_listen_address must differ from listen_address")
+	}
+	return nil
+}
+
+// validationConfig declares rules of request fields by step name and json name of field
+type validationConfig map[pkg.Step]map[string]fieldRuleConfig
+
+type fieldRuleConfig struct {
+	Required bool `json:"required,omitempty"`
+	// field is required when the other one is empty
+	RequiredWithout string `json:"required_without,omitempty"`
+	MinLength       int    `json:"min_length,omitempty"`
+	MaxLength       int    `json:"max_length,omitempty"`
+	// regular expression whole value must match
+	Pattern    string   `json:"pattern,omitempty"`
+	UrlSchemes []string `json:"url_schemes,omitempty"`
+}
+
+func (c validationConfig) rules() (pkg.ValidationRules, error) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+	defaults := pkg.DefaultValidationRules()
+	rules := make(pkg.ValidationRules, len(c))
+	for step, fields := range c {
+		if defaults[step] == nil {
+			return nil, errors.Errorf("unknown step %s in validation", step)
+		}
+		rules[step] = make(pkg.FieldRules, len(fields))
+		for name, f := range fields {
+			if _, ok := defaults[step][name]; !ok {
+				return nil, errors.Errorf("unknown field %s of %s in validation", name, step)
+			}
+			rules[step][name] = pkg.FieldRule{
+				Required:        f.Required,
+				RequiredWithout: f.RequiredWithout,
+				MinLength:       f.MinLength,
+				MaxLength:       f.MaxLength,
+				Pattern:         f.Pattern,
+				UrlSchemes:      f.UrlSchemes,
+			}
+		}
+	}
+	return rules, pkg.CheckValidationRules(rules)
+}
+
+type endpointLimitConfig struct {
+	Application limitConfig `json:"application"`
+	Identity    limitConfig `json:"identity"`
+	Order       limitConfig `json:"order"`
+}
+
+type limitConfig struct {
+	Requests int      `json:"requests,omitempty"`
+	Per      duration `json:"per,omitempty"`
+	Burst    int      `json:"burst,omitempty"`
+}
+
+func (c limitConfig) limit() (web.Limit, error) {
+	if c.Requests < 0 || c.Per < 0 || c.Burst < 0 {
+		return web.Limit{}, errors.New("limit values must not be negative")
+	}
+	if c.Requests > 0 && c.Per == 0 {
+		return web.Limit{}, errors.New("per is required when requests are limited")
+	}
+	return web.Limit{
+		Requests: c.Requests,
+		Per:      time.Duration(c.Per),
+		Burst:    c.Burst,
+	}, nil
+}
+
+// rateLimits returns configured limits, or default ones if none are configured
+func (c *config) rateLimits() (web.RateLimits, error) {
+	if c.RateLimits == nil {
+		return web.DefaultRateLimits(), nil
+	}
+	limits := make(web.RateLimits, len(c.RateLimits))
+	for step, e := range c.RateLimits {
+		switch step {
+		case pkg.StepStartHack, pkg.StepSubmitCard, pkg.StepResendCode, pkg.StepConfirmPayment, pkg.StepOrderStatus:
+		default:
+			return nil, errors.Errorf("unknown step %s in rate limits", step)
+		}
+		var l web.EndpointLimits
+		var err error
+		if l.Application, err = e.Application.limit(); err != nil {
+			return nil, errors.Wrapf(err, "error in application limit of %s", step)
+		}
+		if l.Identity, err = e.Identity.limit(); err != nil {
+			return nil, errors.Wrapf(err, "error in identity limit of %s", step)
+		}
+		if l.Order, err = e.Order.limit(); err != nil {
+			return nil, errors.Wrapf(err, "error in order limit of %s", step)
+		}
+		limits[step] = l
+	}
+	return limits, nil
+}
+
+type applicationConfig struct {
+	Name       string `json:"name"`
+	APIKey     string `json:"api_key,omitempty"`
+	HMACSecret string `json:"hmac_secret,omitempty"`
+	Disabled   bool   `json:"disabled,omitempty"`
+}
+
+// applicationCredentials returns credentials of configured applications
+func (c *config) applicationCredentials() ([]web.ApplicationCredentials, error) {
+	names := make(map[string]bool)
+	credentials := make([]web.ApplicationCredentials, 0, len(c.Applications))
+	for _, a := range c.Applications {
+		if a.Name == "" {
+			return nil, errors.New("application name is required")
+		}
+		if a.APIKey == "" && a.HMACSecret == "" {
+			return nil, errors.Errorf("application %s has neither api_key nor hmac_secret", a.Name)
+		}
+		if names[a.Name] {
+			return nil, errors.Errorf("application %s is configured twice", a.Name)
+		}
+		names[a.Name] = true
+		credentials = append(credentials, web.ApplicationCredentials{
+			Application: a.Name,
+			APIKey:      a.APIKey,
+			HMACSecret:  a.HMACSecret,
+			Disabled:    a.Disabled,
+		})
+	}
+	return credentials, nil
+}
+
+// duration is time.Duration in config, written as string, e.g. "30s" or "1m30s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(raw []byte) error {
+	var s string
+	err := json.Unmarshal(raw, &s)
+	if err != nil {
+		return errors.Wrap(err, "duration must be a string")
+	}
+	var parsed time.Duration
+	parsed, err = time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrap(err, "error parsing duration")
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+type bankConfig struct {
+	Name       string `json:"name"`
+	BaseMpiUrl string `json:"mpi_base_url"`
+	// hosts of payment urls, "*.example.com" matches subdomains, host of mpi_base_url if empty
+	PaymentHosts []string `json:"payment_hosts,omitempty"`
+	// hosts of ACS and merchant pages, mpi and payment hosts are always allowed
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+	// CIDRs of private networks bank hosts may resolve to, e.g. "10.20.0.0/16"
+	AllowedNetworks []string          `json:"allowed_networks,omitempty"`
+	Timeout         duration          `json:"timeout,omitempty"`
+	StepTimeouts    stepTimeoutConfig `json:"step_timeouts"`
+	// overrides validation rules of service for requests of the bank
+	Validation validationConfig `json:"validation,omitempty"`
+	// merchant API user of order status requests, some installations answer without credentials
+	MerchantUserName string `json:"merchant_user_name,omitempty"`
+	MerchantPassword string `json:"merchant_password,omitempty"`
+	// patterns of merchant return and fail urls, "*" matches any characters, e.g. "https://shop.example/pay/fail*"
+	ReturnUrls []string `json:"return_urls,omitempty"`
+	FailUrls   []string `json:"fail_urls,omitempty"`
+}
+
+func (c stepTimeoutConfig) stepTimeouts() pkg.StepTimeouts {
+	return pkg.StepTimeouts{
+		StartHack:      time.Duration(c.StartHack),
+		SubmitCard:     time.Duration(c.SubmitCard),
+		ResendCode:     time.Duration(c.ResendCode),
+		ConfirmPayment: time.Duration(c.ConfirmPayment),
+		OrderStatus:    time.Duration(c.OrderStatus),
+	}
+}
+
+// bankProfiles returns configured banks, or single "default" bank of base_mpi_url
+func (c *config) bankProfiles() ([]pkg.BankProfile, error) {
+	if len(c.Banks) == 0 {
+		if c.BaseMpiUrl == "" {
+			return nil, errors.New("neither banks nor base_mpi_url are configured")
+		}
+		profile := pkg.BankProfile{Name: "default", BaseMpiUrl: c.BaseMpiUrl}
+		return []pkg.BankProfile{profile}, profile.Validate()
+	}
+	names := make(map[string]bool)
+	profiles := make([]pkg.BankProfile, 0, len(c.Banks))
+	for _, b := range c.Banks {
+		profile := pkg.BankProfile{
+			Name:             b.Name,
+			BaseMpiUrl:       b.BaseMpiUrl,
+			PaymentHosts:     b.PaymentHosts,
+			AllowedHosts:     b.AllowedHosts,
+			AllowedNetworks:  b.AllowedNetworks,
+			Timeout:          time.Duration(b.Timeout),
+			StepTimeouts:     b.StepTimeouts.stepTimeouts(),
+			MerchantUserName: b.MerchantUserName,
+			MerchantPassword: b.MerchantPassword,
+			ReturnUrls:       b.ReturnUrls,
+			FailUrls:         b.FailUrls,
+		}
+		var err error
+		if err = b.StepTimeouts.check(); err != nil {
+			return nil, errors.Wrapf(err, "error in step timeouts of bank %s", b.Name)
+		}
+		if profile.Validation, err = b.Validation.rules(); err != nil {
+			return nil, errors.Wrapf(err, "error in validation of bank %s", b.Name)
+		}
+		if err = profile.Validate(); err != nil {
+			return nil, err
+		}
+		if names[profile.Name] {
+			return nil, errors.Errorf("bank %s is configured twice", profile.Name)
+		}
+		names[profile.Name] = true
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// httpConfig configures requests to banks, omitted values keep service defaults
+type httpConfig struct {
+	Timeout             *duration         `json:"timeout,omitempty"`
+	MaxIdleConns        *int              `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost *int              `json:"max_idle_conns_per_host,omitempty"`
+	MaxConnsPerHost     *int              `json:"max_conns_per_host,omitempty"`
+	IdleConnTimeout     *duration         `json:"idle_conn_timeout,omitempty"`
+	DialTimeout         *duration         `json:"dial_timeout,omitempty"`
+	TLSHandshakeTimeout *duration         `json:"tls_handshake_timeout,omitempty"`
+	KeepAlive           *duration         `json:"keep_alive,omitempty"`
+	DisableHTTP2        bool              `json:"disable_http2,omitempty"`
+	StepTimeouts        stepTimeoutConfig `json:"step_timeouts"`
+	Retries             retryConfig       `json:"retries"`
+	CircuitBreaker      breakerConfig     `json:"circuit_breaker"`
+}
+
+// breakerConfig configures circuit breaker of every bank MPI host, omitted values keep defaults
+type breakerConfig struct {
+	// zero disables breakers
+	FailureRatio   *float64  `json:"failure_ratio,omitempty"`
+	MinRequests    *int      `json:"min_requests,omitempty"`
+	Window         *duration `json:"window,omitempty"`
+	OpenTimeout    *duration `json:"open_timeout,omitempty"`
+	HalfOpenProbes *int      `json:"half_open_probes,omitempty"`
+}
+
+func (c breakerConfig) breakerConfig() pkg.BreakerConfig {
+	b := pkg.DefaultBreakerConfig()
+	if c.FailureRatio != nil {
+		b.FailureRatio = *c.FailureRatio
+	}
+	if c.MinRequests != nil {
+		b.MinRequests = *c.MinRequests
+	}
+	if c.Window != nil {
+		b.Window = time.Duration(*c.Window)
+	}
+	if c.OpenTimeout != nil {
+		b.OpenTimeout = time.Duration(*c.OpenTimeout)
+	}
+	if c.HalfOpenProbes != nil {
+		b.HalfOpenProbes = *c.HalfOpenProbes
+	}
+	return b
+}
+
+// retryConfig configures retries of requests safe to repeat, omitted values keep defaults
+type retryConfig struct {
+	SessionStatus retryPolicyConfig `json:"session_status"`
+	ACSPage       retryPolicyConfig `json:"acs_page"`
+	OrderStatus   retryPolicyConfig `json:"order_status"`
+}
+
+type retryPolicyConfig struct {
+	MaxRetries *int      `json:"max_retries,omitempty"`
+	BaseDelay  *duration `json:"base_delay,omitempty"`
+	MaxDelay   *duration `json:"max_delay,omitempty"`
+}
+
+func (c retryPolicyConfig) apply(p pkg.RetryPolicy) pkg.RetryPolicy {
+	if c.MaxRetries != nil {
+		p.MaxRetries = *c.MaxRetries
+	}
+	if c.BaseDelay != nil {
+		p.BaseDelay = time.Duration(*c.BaseDelay)
+	}
+	if c.MaxDelay != nil {
+		p.MaxDelay = time.Duration(*c.MaxDelay)
+	}
+	return p
+}
+
+func (c retryConfig) retryPolicies() pkg.RetryPolicies {
+	p := pkg.DefaultRetryPolicies()
+	p.SessionStatus = c.SessionStatus.apply(p.SessionStatus)
+	p.ACSPage = c.ACSPage.apply(p.ACSPage)
+	p.OrderStatus = c.OrderStatus.apply(p.OrderStatus)
+	return p
+}
+
+type stepTimeoutConfig struct {
+	StartHack      duration `json:"start_hack,omitempty"`
+	SubmitCard     duration `json:"submit_card,omitempty"`
+	ResendCode     duration `json:"resend_code,omitempty"`
+	ConfirmPayment duration `json:"confirm_payment,omitempty"`
+	OrderStatus    duration `json:"order_status,omitempty"`
+}
+
+// serverWriteTimeout cuts connection of client, steps must time out before it to answer with json error
+const serverWriteTimeout = 60 * time.Second
+
+func (c stepTimeoutConfig) check() error {
+	timeouts := []struct {
+		name    string
+		timeout duration
+	}{
+		{"start_hack", c.StartHack},
+		{"submit_card", c.SubmitCard},
+		{"resend_code", c.ResendCode},
+		{"confirm_payment", c.ConfirmPayment},
+		{"order_status", c.OrderStatus},
+	}
+	for _, t := range timeouts {
+		if time.Duration(t.timeout) >= serverWriteTimeout {
+			return errors.Errorf("step timeout %s of %s must be shorter than write timeout %s",
+				time.Duration(t.timeout), t.name, serverWriteTimeout)
+		}
+	}
+	return nil
+}
+
+func (c httpConfig) options() []pkg.Option {
+	timeout := pkg.DefaultTimeout
+	if c.Timeout != nil {
+		timeout = time.Duration(*c.Timeout)
+	}
+	transport := pkg.DefaultTransportConfig()
+	if c.MaxIdleConns != nil {
+		transport.MaxIdleConns = *c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost != nil {
+		transport.MaxIdleConnsPerHost = *c.MaxIdleConnsPerHost
+	}
+	if c.MaxConnsPerHost != nil {
+		transport.MaxConnsPerHost = *c.MaxConnsPerHost
+	}
+	if c.IdleConnTimeout != nil {
+		transport.IdleConnTimeout = time.Duration(*c.IdleConnTimeout)
+	}
+	if c.DialTimeout != nil {
+		transport.DialTimeout = time.Duration(*c.DialTimeout)
+	}
+	if c.TLSHandshakeTimeout != nil {
+		transport.TLSHandshakeTimeout = time.Duration(*c.TLSHandshakeTimeout)
+	}
+	if c.KeepAlive != nil {
+		transport.KeepAlive = time.Duration(*c.KeepAlive)
+	}
+	transport.DisableHTTP2 = c.DisableHTTP2
+	return []pkg.Option{
+		pkg.WithTimeout(timeout),
+		pkg.WithTransportConfig(transport),
+		pkg.WithStepTimeouts(c.StepTimeouts.stepTimeouts()),
+		pkg.WithRetryPolicies(c.Retries.retryPolicies()),
+		pkg.WithBreakerConfig(c.CircuitBreaker.breakerConfig()),
+	}
+}
+
+type sessionStoreConfig struct {
+	// one of "memory" (default) or "bolt"
+	Type string `json:"type,omitempty"`
+	// path to database file, used by "bolt"
+	Path string `json:"path,omitempty"`
+}
+
+func newSessionStore(c sessionStoreConfig) (pkg.SessionStore, error) {
+	switch c.Type {
+	case "", "memory":
+		return pkg.NewMemorySessionStore(), nil
+	case "bolt":
+		if c.Path == "" {
+			return nil, errors.New("session store path is required for bolt")
+		}
+		return pkg.NewBoltSessionStore(c.Path)
+	default:
+		return nil, errors.Errorf("unknown session store type: %s", c.Type)
+	}
+}
+
+func ReadConfig(source string) (c *config, err error) {
+	var raw []byte
+	raw, err = os.ReadFile(source)
+	if err != nil {
+		eMsg := "error reading config from file"
+		log.WithError(err).Error(eMsg)
+		err = errors.Wrap(err, eMsg)
+		return
+	}
+	err = json.Unmarshal(raw, &c)
+	if err != nil {
+		eMsg := "error parsing config from json"
+		log.WithError(err).Error(eMsg)
+		err = errors.Wrap(err, eMsg)
+		c = nil
+	}
+	return
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"syscall"
 	"time"
 
@@ -15,36 +15,17 @@ import (
 	"github.com/pkg/errors"
 
 	"ykjam/bpchack/pkg"
+	"ykjam/bpchack/pkg/bpc/classify"
+	"ykjam/bpchack/pkg/metrics"
+	"ykjam/bpchack/pkg/redact"
 	"ykjam/bpchack/pkg/web"
 )
 
-type config struct {
-	ListenAddress string `json:"listen_address"`
-	BaseMpiUrl    string `json:"base_mpi_url,omitempty"`
-}
-
-func ReadConfig(source string) (c *config, err error) {
-	var raw []byte
-	raw, err = os.ReadFile(source)
-	if err != nil {
-		eMsg := "error reading config from file"
-		log.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		return
-	}
-	err = json.Unmarshal(raw, &c)
-	if err != nil {
-		eMsg := "error parsing config from json"
-		log.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		c = nil
-	}
-	return
-}
-
 func run() error {
+	redact.Install()
 	log.Info("Starting BPC Hack proxy")
 	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 	quitChan := make(chan interface{})
 
 	var configFile string
@@ -64,43 +45,141 @@ func run() error {
 		log.WithError(err).WithField("config-file", configFile).Error("error loading configuration")
 		return err
 	}
-	service := pkg.NewService(conf.BaseMpiUrl, 60*time.Second)
-	log.Info("service initialized")
+	err = conf.checkAdmin()
+	if err != nil {
+		log.WithError(err).Error("error in admin configuration")
+		return err
+	}
+	err = conf.HTTP.StepTimeouts.check()
+	if err != nil {
+		log.WithError(err).Error("error in step timeouts")
+		return err
+	}
+	var banks []pkg.BankProfile
+	banks, err = conf.bankProfiles()
+	if err != nil {
+		log.WithError(err).Error("error in bank configuration")
+		return err
+	}
+	var sessions pkg.SessionStore
+	sessions, err = newSessionStore(conf.SessionStore)
+	if err != nil {
+		log.WithError(err).Error("error setting up session store")
+		return err
+	}
+	defer func() {
+		errClose := sessions.Close()
+		if errClose != nil {
+			log.WithError(errClose).Error("error closing session store")
+		}
+	}()
+	log.WithField("type", conf.SessionStore.Type).Info("session store initialized")
+	tracerProvider, shutdownTracing, err := newTracerProvider(context.Background(), conf.Tracing)
+	if err != nil {
+		log.WithError(err).Error("error setting up tracing")
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		errShutdown := shutdownTracing(ctx)
+		if errShutdown != nil {
+			log.WithError(errShutdown).Error("error flushing traces")
+		}
+	}()
+	log.WithField("exporter", conf.Tracing.Exporter).Info("tracing initialized")
+	registry := metrics.NewRegistry()
+	var validation pkg.ValidationRules
+	validation, err = conf.Validation.rules()
+	if err != nil {
+		log.WithError(err).Error("error in validation configuration")
+		return err
+	}
+	catalogue := classify.Default()
+	if conf.BankErrorsCatalogue != "" {
+		catalogue, err = classify.Load(conf.BankErrorsCatalogue)
+		if err != nil {
+			log.WithError(err).WithField("path", conf.BankErrorsCatalogue).Error("error loading bank errors catalogue")
+			return err
+		}
+	}
+	service := pkg.NewService(banks, append(conf.HTTP.options(),
+		pkg.WithValidationRules(validation),
+		pkg.WithErrorCatalogue(catalogue),
+		pkg.WithSessionStore(sessions),
+		pkg.WithMetrics(metrics.NewPrometheus(registry)),
+		pkg.WithTracerProvider(tracerProvider))...)
+	log.WithField("banks", len(banks)).Info("service initialized")
 
-	hc := web.NewHandlerContext(service)
+	var limits web.RateLimits
+	limits, err = conf.rateLimits()
+	if err != nil {
+		log.WithError(err).Error("error in rate limit configuration")
+		return err
+	}
+	hc := web.NewHandlerContext(service, web.WithRateLimiter(web.NewRateLimiter(limits)))
+	var credentials []web.ApplicationCredentials
+	credentials, err = conf.applicationCredentials()
+	if err != nil {
+		log.WithError(err).Error("error in application configuration")
+		return err
+	}
+	if len(credentials) == 0 {
+		log.Warn("no applications configured, workflow endpoints are not authenticated")
+	}
+	auth := web.NewAuthenticator(credentials)
 
 	sm := http.NewServeMux()
 	sm.HandleFunc("/api/epoch", hc.HandleUtilityEpoch)
 	sm.HandleFunc("/api/ip", hc.HandleUtilityIP)
-	sm.HandleFunc("/api/v1/start-hack", hc.HandleStartHack)
-	sm.HandleFunc("/api/v1/submit-card", hc.HandleSubmitCard)
-	sm.HandleFunc("/api/v1/resend-code", hc.HandleResendCode)
-	sm.HandleFunc("/api/v1/confirm-payment", hc.HandleConfirmPayment)
+	sm.Handle("/api/v1/start-hack", auth.Middleware(http.HandlerFunc(hc.HandleStartHack)))
+	sm.Handle("/api/v1/submit-card", auth.Middleware(http.HandlerFunc(hc.HandleSubmitCard)))
+	sm.Handle("/api/v1/resend-code", auth.Middleware(http.HandlerFunc(hc.HandleResendCode)))
+	sm.Handle("/api/v1/confirm-payment", auth.Middleware(http.HandlerFunc(hc.HandleConfirmPayment)))
+	sm.Handle("/api/v1/order-status", auth.Middleware(http.HandlerFunc(hc.HandleOrderStatus)))
+	sm.Handle("/api/v2/start-hack", auth.Middleware(http.HandlerFunc(hc.HandleStartHackV2)))
+	sm.Handle("/api/v2/submit-card", auth.Middleware(http.HandlerFunc(hc.HandleSubmitCardV2)))
+	sm.Handle("/api/v2/resend-code", auth.Middleware(http.HandlerFunc(hc.HandleResendCodeV2)))
+	sm.Handle("/api/v2/confirm-payment", auth.Middleware(http.HandlerFunc(hc.HandleConfirmPaymentV2)))
+	sm.Handle("/api/v2/order-status", auth.Middleware(http.HandlerFunc(hc.HandleOrderStatusV2)))
+	if conf.Debug {
+		log.Warn("debug endpoints enabled")
+		sm.Handle("/api/debug/session", auth.Middleware(http.HandlerFunc(hc.HandleDebugSession)))
+	}
 
-	server := http.Server{
-		Addr:              conf.ListenAddress,
-		Handler:           sm,
-		ReadTimeout:       60 * time.Second,
-		ReadHeaderTimeout: 30 * time.Second,
-		WriteTimeout:      60 * time.Second,
-		IdleTimeout:       120 * time.Second,
+	// metrics and admin endpoints are never served on public listener
+	servers := []*http.Server{newServer(conf.ListenAddress, sm)}
+	if conf.AdminListenAddress != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/metrics", metrics.Handler(registry))
+		if conf.Admin {
+			log.Info("admin endpoints enabled")
+			admin.HandleFunc("/api/admin/breakers", hc.HandleAdminBreakers)
+		}
+		servers = append(servers, newServer(conf.AdminListenAddress, admin))
+	} else {
+		log.Warn("no admin listen address configured, metrics are not served")
 	}
-	var listener net.Listener
-	listener, err = net.Listen("tcp", conf.ListenAddress)
-	if err != nil {
-		log.WithError(err).Error("error setting up listener")
-		return err
+	for _, server := range servers {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.WithError(err).WithField("listen", server.Addr).Error("error setting up listener")
+			return err
+		}
+		log.WithField("listen", server.Addr).Info("Starting HTTP API server")
+		go startServer(server, listener)
 	}
-	log.WithField("listen", conf.ListenAddress).Info("Starting HTTP API server")
-	go startServer(&server, listener)
 	for {
 		select {
 		case <-quitChan:
 			log.Warn("quit channel closed, closing listener")
-			err = server.Shutdown(context.Background())
-			if err != nil {
-				log.WithError(err).Error("error during HTTP server shutdown")
-				return err
+			for _, server := range servers {
+				err = server.Shutdown(context.Background())
+				if err != nil {
+					log.WithError(err).WithField("listen", server.Addr).Error("error during HTTP server shutdown")
+					return err
+				}
 			}
 			return nil
 		case sig := <-signalChan:
@@ -113,9 +192,20 @@ func run() error {
 	}
 }
 
+func newServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           web.RequestId(handler),
+		ReadTimeout:       60 * time.Second,
+		ReadHeaderTimeout: 30 * time.Second,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       120 * time.Second,
+	}
+}
+
 func startServer(srv *http.Server, listener net.Listener) {
 	err := srv.Serve(listener)
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.WithError(err).Error("HTTP API server error")
 	}
 	log.Warn("closing HTTP API server")
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type tracingConfig struct {
+	// one of "" (disabled), "otlp", "stdout" or "file"
+	Exporter string `json:"exporter,omitempty"`
+	// host:port of OTLP/HTTP collector, OTEL_EXPORTER_OTLP_ENDPOINT is used if empty
+	Endpoint string `json:"endpoint,omitempty"`
+	// send spans to collector over plain http
+	Insecure bool `json:"insecure,omitempty"`
+	// file spans are appended to by "file" exporter
+	Path string `json:"path,omitempty"`
+	// "bpchackd" if empty
+	ServiceName string `json:"service_name,omitempty"`
+	// share of new traces recorded, traces started by calling application follow its decision, 1 if omitted
+	SampleRatio *float64 `json:"sample_ratio,omitempty"`
+}
+
+// newTracerProvider sets up exporter of config, shutdown flushes spans left and must be called on exit
+func newTracerProvider(ctx context.Context, c tracingConfig) (provider trace.TracerProvider, shutdown func(context.Context) error, err error) {
+	var exporter sdktrace.SpanExporter
+	var file io.Closer
+	switch c.Exporter {
+	case "":
+		return trace.NewNoopTracerProvider(), func(context.Context) error { return nil }, nil
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "file":
+		if c.Path == "" {
+			return nil, nil, errors.New("tracing path is required for file exporter")
+		}
+		var f *os.File
+		f, err = os.OpenFile(c.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error opening tracing file")
+		}
+		file = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, nil, errors.Errorf("unknown tracing exporter: %s", c.Exporter)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating tracing exporter")
+	}
+	serviceName := c.ServiceName
+	if serviceName == "" {
+		serviceName = "bpchackd"
+	}
+	ratio := 1.0
+	if c.SampleRatio != nil {
+		ratio = *c.SampleRatio
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+	shutdown = func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if file != nil {
+			if errClose := file.Close(); errClose != nil && err == nil {
+				err = errClose
+			}
+		}
+		return err
+	}
+	return tp, shutdown, nil
+}
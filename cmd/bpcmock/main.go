@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/joho/godotenv"
+	"github.com/pkg/errors"
+
+	"ykjam/bpchack/pkg/bpc/mock"
+)
+
+func run() error {
+	log.Info("Starting BPC mock server")
+	err := godotenv.Load()
+	if err != nil {
+		log.WithError(err).Error("error loading .env, ignoring")
+	}
+	listenAddress := os.Getenv("BPCMOCK_LISTEN_ADDRESS")
+	if listenAddress == "" {
+		listenAddress = "127.0.0.1:9091"
+	}
+	scenarioName := os.Getenv("BPCMOCK_SCENARIO")
+	if scenarioName == "" {
+		scenarioName = mock.ScenarioSuccess
+	}
+	scenario, ok := mock.ScenarioByName(scenarioName)
+	if !ok {
+		eMsg := fmt.Sprintf("unknown scenario %s, available: %s", scenarioName,
+			strings.Join(mock.ScenarioNames(), ", "))
+		log.Error(eMsg)
+		return errors.New(eMsg)
+	}
+
+	server := http.Server{
+		Addr:              listenAddress,
+		Handler:           mock.NewServer(scenario),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	var listener net.Listener
+	listener, err = net.Listen("tcp", listenAddress)
+	if err != nil {
+		log.WithError(err).Error("error setting up listener")
+		return err
+	}
+	log.WithFields(log.Fields{
+		"listen":       listenAddress,
+		"scenario":     scenario.Name,
+		"base-mpi-url": fmt.Sprintf("http://%s%s", listener.Addr(), mock.MPIPath),
+	}).Info("Starting BPC mock server")
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		log.Info("interrupt signal received, shutting down")
+		errShutdown := server.Shutdown(context.Background())
+		if errShutdown != nil {
+			log.WithError(errShutdown).Error("error during HTTP server shutdown")
+		}
+	}()
+	err = server.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("BPC mock server error")
+		return err
+	}
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BankProfile describes BPC installation of a single bank
+type BankProfile struct {
+	Name       string
+	BaseMpiUrl string
+	// hosts payment urls of the bank are served from, "*.example.com" matches any subdomain,
+	// host of BaseMpiUrl is used if empty
+	PaymentHosts []string
+	// hosts of ACS and merchant pages the payment flow may be sent to besides MPI and payment hosts,
+	// "*.example.com" matches any subdomain
+	AllowedHosts []string
+	// CIDRs of private or loopback networks bank hosts may resolve to, such addresses are refused otherwise
+	AllowedNetworks []string
+	// override service timeouts when not zero
+	Timeout      time.Duration
+	StepTimeouts StepTimeouts
+	// override rules of service for the same fields
+	Validation ValidationRules
+	// credentials of merchant API user, sent with order status requests if given
+	MerchantUserName string
+	MerchantPassword string
+	// patterns of merchant return and fail urls, "*" matches any characters, query is ignored,
+	// return and fail urls given to start hack take precedence, fail url wins when both match
+	ReturnUrls []string
+	FailUrls   []string
+
+	policy         *destinationPolicy
+	transport      *http.Transport
+	breaker        *breaker
+	validator      validator
+	returnPatterns []urlPattern
+	failPatterns   []urlPattern
+}
+
+var ErrUnknownBank = errors.New("payment url does not belong to any known bank")
+
+// ErrSessionRequired is returned for steps without token when more than one bank is configured,
+// only session tells which bank the payment belongs to
+var ErrSessionRequired = errors.New("token is required when more than one bank is configured")
+
+// label returns name of bank for logs and metrics, empty when bank is not known yet
+func (b *BankProfile) label() string {
+	if b == nil {
+		return ""
+	}
+	return b.Name
+}
+
+func (b *BankProfile) sessionStatusUrl() string {
+	return fmt.Sprintf("%s/getSessionStatus.do", b.BaseMpiUrl)
+}
+
+func (b *BankProfile) processFormUrl() string {
+	return fmt.Sprintf("%s/processform.do", b.BaseMpiUrl)
+}
+
+func (b *BankProfile) orderStatusUrl() string {
+	return fmt.Sprintf("%s/getOrderStatusExtended.do", b.BaseMpiUrl)
+}
+
+func (b *BankProfile) paymentHosts() []string {
+	if len(b.PaymentHosts) > 0 {
+		return b.PaymentHosts
+	}
+	u, err := url.Parse(b.BaseMpiUrl)
+	if err != nil {
+		return nil
+	}
+	return []string{u.Hostname()}
+}
+
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// ServesPaymentUrl reports whether payment url belongs to the bank
+func (b *BankProfile) ServesPaymentUrl(u *url.URL) bool {
+	host := u.Hostname()
+	if host == "" {
+		return false
+	}
+	for _, pattern := range b.paymentHosts() {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks profile is usable
+func (b *BankProfile) Validate() error {
+	if b.Name == "" {
+		return errors.New("bank name is required")
+	}
+	u, err := url.Parse(b.BaseMpiUrl)
+	if err != nil {
+		return errors.Wrapf(err, "invalid mpi base url of bank %s", b.Name)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return errors.Errorf("invalid mpi base url of bank %s: %s", b.Name, b.BaseMpiUrl)
+	}
+	if _, err = parseNetworks(b.AllowedNetworks); err != nil {
+		return errors.Wrapf(err, "invalid allowed networks of bank %s", b.Name)
+	}
+	if err = CheckValidationRules(b.Validation); err != nil {
+		return errors.Wrapf(err, "invalid validation rules of bank %s", b.Name)
+	}
+	for _, pattern := range append(append([]string(nil), b.ReturnUrls...), b.FailUrls...) {
+		if !strings.Contains(pattern, "://") {
+			return errors.Errorf("url pattern %s of bank %s has no scheme", pattern, b.Name)
+		}
+	}
+	return nil
+}
+
+// destinationHosts returns hosts requests of the bank flow may be sent to
+func (b *BankProfile) destinationHosts() []string {
+	hosts := append([]string(nil), b.paymentHosts()...)
+	if u, err := url.Parse(b.BaseMpiUrl); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+	return append(hosts, b.AllowedHosts...)
+}
+
+// checkDestination verifies urls received from bank or client before sending anything to them
+func (b *BankProfile) checkDestination(urls ...string) error {
+	for _, u := range urls {
+		if err := b.policy.checkUrl(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bankByPaymentUrl returns the first bank serving payment url
+func (s *service) bankByPaymentUrl(u *url.URL) (*BankProfile, error) {
+	for i := range s.banks {
+		if s.banks[i].ServesPaymentUrl(u) {
+			return &s.banks[i], nil
+		}
+	}
+	return nil, ErrUnknownBank
+}
+
+// bankByName returns bank of session, flows without session are served only when there is a single bank
+func (s *service) bankByName(name string) (*BankProfile, error) {
+	if name == "" {
+		if len(s.banks) != 1 {
+			return nil, ErrSessionRequired
+		}
+		return &s.banks[0], nil
+	}
+	for i := range s.banks {
+		if s.banks[i].Name == name {
+			return &s.banks[i], nil
+		}
+	}
+	return nil, errors.Errorf("bank %s is not configured", name)
+}
+
+// timeoutsFor returns step timeouts of service overridden by bank
+func (s *service) timeoutsFor(bank *BankProfile) StepTimeouts {
+	t := s.stepTimeouts
+	if bank.StepTimeouts.StartHack > 0 {
+		t.StartHack = bank.StepTimeouts.StartHack
+	}
+	if bank.StepTimeouts.SubmitCard > 0 {
+		t.SubmitCard = bank.StepTimeouts.SubmitCard
+	}
+	if bank.StepTimeouts.ResendCode > 0 {
+		t.ResendCode = bank.StepTimeouts.ResendCode
+	}
+	if bank.StepTimeouts.ConfirmPayment > 0 {
+		t.ConfirmPayment = bank.StepTimeouts.ConfirmPayment
+	}
+	if bank.StepTimeouts.OrderStatus > 0 {
+		t.OrderStatus = bank.StepTimeouts.OrderStatus
+	}
+	return t
+}
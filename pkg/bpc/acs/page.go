@@ -0,0 +1,259 @@
+package acs
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// ACS pages rendered by BPC contain the following markup we are interested in
+//
+// 3D Secure phone number the one-time password is sent to
+//
+// <div id="tipContainer" class="tipContainer"><span class="tip">One-time password will be sent to number {3DSECURE}</span></div>
+//
+// password send attempts left
+//
+// <a id="resendPasswordLink" href="#" title="{N} password send attempt(s) left" onclick="jsf.util.chain
+//
+// wrong password attempts
+//
+// <div id="errorContainer" class="errorContainer"><ul><li class="errorMessage">	Wrong password typed attempt {1} of {3} </li></ul></div>
+//
+// operation cancelled after too many wrong passwords
+//
+// <span class="operationCancelledMessage">Operation cancelled</span>
+//
+// payment response to be posted to TermUrl
+//
+// <input type="hidden" name="PaRes" value="{CODE}" />
+
+// Field identifies value extracted from ACS page
+type Field string
+
+const (
+	FieldPhoneTip              Field = "phone-tip"
+	FieldResendAttempts        Field = "resend-attempts"
+	FieldWrongPasswordAttempts Field = "wrong-password-attempts"
+	FieldPaymentResponse       Field = "pa-res"
+)
+
+var ErrFieldNotFound = errors.New("field not found in acs page")
+
+// FieldNotFoundError is returned by ACSPage.Require for fields missing in page,
+// errors.Is(err, ErrFieldNotFound) holds for it
+type FieldNotFoundError struct {
+	Field Field
+}
+
+func (e *FieldNotFoundError) Error() string {
+	return fmt.Sprintf("field %s not found in acs page", e.Field)
+}
+
+func (e *FieldNotFoundError) Is(target error) bool {
+	return target == ErrFieldNotFound
+}
+
+// MalformedFieldError is returned by ACSPage.Require when element holding field exists, but its value can not be parsed.
+// Parse keeps going past malformed fields, so the rest of page is not lost
+type MalformedFieldError struct {
+	Field Field
+	Value string
+}
+
+func (e *MalformedFieldError) Error() string {
+	return fmt.Sprintf("malformed field %s in acs page: %q", e.Field, e.Value)
+}
+
+// ACSPage contains values extracted from ACS page, use Has or Require to check presence of value
+type ACSPage struct {
+	// full text of tip, e.g. "One-time password will be sent to number +99365XXXX11"
+	PhoneTip string
+	// number extracted from PhoneTip
+	ThreeDSecureNumber string
+	ResendAttemptsLeft int
+	// current wrong password attempt and total allowed attempts
+	WrongPasswordAttempt       int
+	WrongPasswordTotalAttempts int
+	// PaRes to be posted to TermUrl
+	PaymentResponse string
+	// operation was cancelled by ACS, usually after too many wrong passwords
+	Cancelled bool
+
+	found map[Field]bool
+	// raw values of fields which could not be parsed
+	malformed map[Field]string
+}
+
+func (p *ACSPage) Has(field Field) bool {
+	return p.found[field]
+}
+
+// Require returns MalformedFieldError or FieldNotFoundError for the first of fields missing in page
+func (p *ACSPage) Require(fields ...Field) error {
+	for _, field := range fields {
+		if p.found[field] {
+			continue
+		}
+		if value, ok := p.malformed[field]; ok {
+			return &MalformedFieldError{Field: field, Value: value}
+		}
+		return &FieldNotFoundError{Field: field}
+	}
+	return nil
+}
+
+var rLeadingNumber = regexp.MustCompile(`^\s*(\d+)`)
+var rAttemptOfTotal = regexp.MustCompile(`(\d+)\D+(\d+)`)
+
+// capture collects text of element until its closing tag
+type capture struct {
+	tag   string
+	field Field
+	depth int
+	text  strings.Builder
+}
+
+func hasClass(t html.Token, class string) bool {
+	for _, c := range strings.Fields(attr(t, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func attr(t html.Token, name string) string {
+	for _, a := range t.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// Parse reads ACS page html from r
+func Parse(r io.Reader) (page *ACSPage, err error) {
+	page = &ACSPage{found: make(map[Field]bool), malformed: make(map[Field]string)}
+	z := html.NewTokenizer(r)
+	var c *capture
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return
+			}
+			err = errors.Wrap(z.Err(), "error tokenizing acs page")
+			page = nil
+			return
+		case html.TextToken:
+			if c != nil {
+				c.text.Write(z.Text())
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if c != nil {
+				if t.Data == c.tag && tt == html.StartTagToken {
+					c.depth++
+				}
+				continue
+			}
+			switch {
+			case t.Data == "span" && hasClass(t, "tip"):
+				c = &capture{tag: t.Data, field: FieldPhoneTip}
+			case t.Data == "li" && hasClass(t, "errorMessage"):
+				c = &capture{tag: t.Data, field: FieldWrongPasswordAttempts}
+			case t.Data == "span" && hasClass(t, "operationCancelledMessage"):
+				page.Cancelled = true
+			case t.Data == "a" && attr(t, "id") == "resendPasswordLink":
+				page.setResendAttempts(attr(t, "title"))
+			case t.Data == "input" && attr(t, "name") == "PaRes":
+				page.PaymentResponse = attr(t, "value")
+				page.found[FieldPaymentResponse] = true
+			}
+			if c != nil && tt == html.SelfClosingTagToken {
+				c = nil
+			}
+		case html.EndTagToken:
+			if c == nil {
+				continue
+			}
+			t := z.Token()
+			if t.Data != c.tag {
+				continue
+			}
+			if c.depth > 0 {
+				c.depth--
+				continue
+			}
+			page.setCaptured(c.field, strings.TrimSpace(c.text.String()))
+			c = nil
+		}
+	}
+}
+
+// ParseString parses ACS page html
+func ParseString(raw string) (*ACSPage, error) {
+	return Parse(strings.NewReader(raw))
+}
+
+func (p *ACSPage) setResendAttempts(title string) {
+	m := rLeadingNumber.FindStringSubmatch(title)
+	if m == nil {
+		p.malformed[FieldResendAttempts] = title
+		return
+	}
+	attempts, err := strconv.Atoi(m[1])
+	if err != nil {
+		p.malformed[FieldResendAttempts] = title
+		return
+	}
+	p.ResendAttemptsLeft = attempts
+	p.found[FieldResendAttempts] = true
+}
+
+func (p *ACSPage) setCaptured(field Field, text string) {
+	switch field {
+	case FieldPhoneTip:
+		if text == "" {
+			return
+		}
+		p.PhoneTip = text
+		p.ThreeDSecureNumber = phoneFromTip(text)
+		p.found[FieldPhoneTip] = true
+	case FieldWrongPasswordAttempts:
+		if p.found[FieldWrongPasswordAttempts] {
+			return
+		}
+		// error container is used for other messages too, only "attempt N of M" is interesting
+		m := rAttemptOfTotal.FindStringSubmatch(text)
+		if m == nil {
+			return
+		}
+		current, errCurrent := strconv.Atoi(m[1])
+		total, errTotal := strconv.Atoi(m[2])
+		if errCurrent != nil || errTotal != nil {
+			return
+		}
+		p.WrongPasswordAttempt = current
+		p.WrongPasswordTotalAttempts = total
+		p.found[FieldWrongPasswordAttempts] = true
+	}
+}
+
+// phoneFromTip returns text after the last "number" word of tip, or the last word if there is none
+func phoneFromTip(tip string) string {
+	if index := strings.LastIndex(strings.ToLower(tip), "number"); index != -1 {
+		if number := strings.TrimSpace(tip[index+len("number"):]); number != "" {
+			return number
+		}
+	}
+	words := strings.Fields(tip)
+	return words[len(words)-1]
+}
@@ -0,0 +1,149 @@
+package acs_test
+
+import (
+	"errors"
+	"testing"
+
+	"ykjam/bpchack/pkg/bpc/acs"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want acs.ACSPage
+		// fields expected to be found, the rest must be missing
+		found []acs.Field
+	}{
+		{
+			name: "password page",
+			html: `<html><body><form>
+<div id="tipContainer" class="tipContainer"><span class="tip">One-time password will be sent to number +99365XXXX11</span></div>
+<a id="resendPasswordLink" href="#" title="2 password send attempt(s) left" onclick="jsf.util.chain()">Resend</a>
+</form></body></html>`,
+			want: acs.ACSPage{
+				PhoneTip:           "One-time password will be sent to number +99365XXXX11",
+				ThreeDSecureNumber: "+99365XXXX11",
+				ResendAttemptsLeft: 2,
+			},
+			found: []acs.Field{acs.FieldPhoneTip, acs.FieldResendAttempts},
+		},
+		{
+			name: "attribute order and extra classes",
+			html: `<span data-x="1" class="big tip ">Код отправлен на номер +99361XXXX22</span>
+<a onclick="x()" title="1 попытка" href="#" id="resendPasswordLink">Resend</a>
+<input value="PARES-CODE" type="hidden" name="PaRes"/>`,
+			want: acs.ACSPage{
+				PhoneTip:           "Код отправлен на номер +99361XXXX22",
+				ThreeDSecureNumber: "+99361XXXX22",
+				ResendAttemptsLeft: 1,
+				PaymentResponse:    "PARES-CODE",
+			},
+			found: []acs.Field{acs.FieldPhoneTip, acs.FieldResendAttempts, acs.FieldPaymentResponse},
+		},
+		{
+			name: "whitespace around values",
+			html: `<span class="tip">
+		One-time password will be sent to number   +99365XXXX11
+	</span>
+<a id="resendPasswordLink" title="  3 password send attempt(s) left">Resend</a>`,
+			want: acs.ACSPage{
+				PhoneTip:           "One-time password will be sent to number   +99365XXXX11",
+				ThreeDSecureNumber: "+99365XXXX11",
+				ResendAttemptsLeft: 3,
+			},
+			found: []acs.Field{acs.FieldPhoneTip, acs.FieldResendAttempts},
+		},
+		{
+			name: "nested elements",
+			html: `<span class="tip">Password sent to <span><b>number</b> <span>+99365XXXX11</span></span></span>
+<ul><li class="errorMessage"><span>Wrong password typed</span> attempt <b>2</b> of <b>3</b></li></ul>`,
+			want: acs.ACSPage{
+				PhoneTip:                   "Password sent to number +99365XXXX11",
+				ThreeDSecureNumber:         "+99365XXXX11",
+				WrongPasswordAttempt:       2,
+				WrongPasswordTotalAttempts: 3,
+			},
+			found: []acs.Field{acs.FieldPhoneTip, acs.FieldWrongPasswordAttempts},
+		},
+		{
+			name: "attempt of total",
+			html: `<div id="errorContainer" class="errorContainer"><ul>
+<li class="errorMessage">Session will expire soon</li>
+<li class="errorMessage">	Wrong password typed attempt 1 of 3 </li>
+<li class="errorMessage">Wrong password typed attempt 2 of 3</li>
+</ul></div>`,
+			want: acs.ACSPage{
+				WrongPasswordAttempt:       1,
+				WrongPasswordTotalAttempts: 3,
+			},
+			found: []acs.Field{acs.FieldWrongPasswordAttempts},
+		},
+		{
+			name: "cancelled",
+			html: `<span class="operationCancelledMessage">Operation cancelled</span>`,
+			want: acs.ACSPage{Cancelled: true},
+		},
+		{
+			name: "missing fields",
+			html: `<html><body><span class="tip"> </span><li class="errorMessage">Unknown error</li></body></html>`,
+		},
+		{
+			name: "malformed resend title keeps the rest of page",
+			html: `<a id="resendPasswordLink" title="no attempts left">Resend</a>
+<li class="errorMessage">Wrong password typed attempt 3 of 3</li>
+<input type="hidden" name="PaRes" value="PARES-CODE">`,
+			want: acs.ACSPage{
+				WrongPasswordAttempt:       3,
+				WrongPasswordTotalAttempts: 3,
+				PaymentResponse:            "PARES-CODE",
+			},
+			found: []acs.Field{acs.FieldWrongPasswordAttempts, acs.FieldPaymentResponse},
+		},
+	}
+	fields := []acs.Field{acs.FieldPhoneTip, acs.FieldResendAttempts, acs.FieldWrongPasswordAttempts, acs.FieldPaymentResponse}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := acs.ParseString(tt.html)
+			if err != nil {
+				t.Fatalf("error parsing page: %v", err)
+			}
+			if page.PhoneTip != tt.want.PhoneTip || page.ThreeDSecureNumber != tt.want.ThreeDSecureNumber ||
+				page.ResendAttemptsLeft != tt.want.ResendAttemptsLeft || page.WrongPasswordAttempt != tt.want.WrongPasswordAttempt ||
+				page.WrongPasswordTotalAttempts != tt.want.WrongPasswordTotalAttempts ||
+				page.PaymentResponse != tt.want.PaymentResponse || page.Cancelled != tt.want.Cancelled {
+				t.Errorf("page = %+v, want %+v", *page, tt.want)
+			}
+			for _, field := range fields {
+				want := false
+				for _, f := range tt.found {
+					want = want || f == field
+				}
+				if page.Has(field) != want {
+					t.Errorf("Has(%s) = %v, want %v", field, page.Has(field), want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequire(t *testing.T) {
+	page, err := acs.ParseString(`<a id="resendPasswordLink" title="attempts left: 2">Resend</a>
+<span class="tip">Password sent to number +99365XXXX11</span>`)
+	if err != nil {
+		t.Fatalf("error parsing page: %v", err)
+	}
+	if err := page.Require(acs.FieldPhoneTip); err != nil {
+		t.Errorf("Require(phone-tip) = %v, want nil", err)
+	}
+	var malformed *acs.MalformedFieldError
+	err = page.Require(acs.FieldPhoneTip, acs.FieldResendAttempts)
+	if !errors.As(err, &malformed) || malformed.Field != acs.FieldResendAttempts || malformed.Value != "attempts left: 2" {
+		t.Errorf("Require(resend-attempts) = %v, want malformed field error", err)
+	}
+	var notFound *acs.FieldNotFoundError
+	err = page.Require(acs.FieldPaymentResponse)
+	if !errors.As(err, &notFound) || notFound.Field != acs.FieldPaymentResponse || !errors.Is(err, acs.ErrFieldNotFound) {
+		t.Errorf("Require(pa-res) = %v, want field not found error", err)
+	}
+}
@@ -0,0 +1,135 @@
+// Package classify tells why bank rejected payment by errorCode and error message of processform.do,
+// using catalogue of phrases banks are known to answer with in Russian, Turkmen and English.
+package classify
+
+import (
+	_ "embed"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type Reason string
+
+const (
+	ReasonUnknown              Reason = "unknown"
+	ReasonCVCRequired          Reason = "cvc-required"
+	ReasonUnknownPaymentSystem Reason = "unknown-payment-system"
+	ReasonInsufficientFunds    Reason = "insufficient-funds"
+	ReasonCardBlocked          Reason = "card-blocked"
+	ReasonCardExpired          Reason = "card-expired"
+	ReasonNotEnrolled          Reason = "not-enrolled"
+	ReasonLimitExceeded        Reason = "limit-exceeded"
+)
+
+var knownReasons = map[Reason]bool{
+	ReasonCVCRequired:          true,
+	ReasonUnknownPaymentSystem: true,
+	ReasonInsufficientFunds:    true,
+	ReasonCardBlocked:          true,
+	ReasonCardExpired:          true,
+	ReasonNotEnrolled:          true,
+	ReasonLimitExceeded:        true,
+}
+
+// Entry maps phrases to reason, message matches entry when it contains any of phrases, case-insensitively
+type Entry struct {
+	Reason Reason `json:"reason"`
+	// error codes entry applies to, any if empty
+	ErrorCodes []int `json:"error_codes,omitempty"`
+	// phrases by language, e.g. "ru", "tk" and "en"
+	Phrases map[string][]string `json:"phrases"`
+}
+
+// Catalogue is matched entry by entry, the first matching entry gives the reason
+type Catalogue struct {
+	Entries []Entry `json:"entries"`
+}
+
+//go:embed catalogue.json
+var defaultCatalogue []byte
+
+var builtin *Catalogue
+
+func init() {
+	var err error
+	builtin, err = Parse(defaultCatalogue)
+	if err != nil {
+		panic(errors.Wrap(err, "error in builtin catalogue"))
+	}
+}
+
+// Default returns builtin catalogue, see catalogue.json
+func Default() *Catalogue {
+	return builtin
+}
+
+// Parse reads catalogue written as json, see catalogue.json for example
+func Parse(data []byte) (*Catalogue, error) {
+	var c Catalogue
+	err := json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing catalogue")
+	}
+	for i, e := range c.Entries {
+		if !knownReasons[e.Reason] {
+			return nil, errors.Errorf("unknown reason %q of entry %d", e.Reason, i)
+		}
+		for lang, phrases := range e.Phrases {
+			for j, phrase := range phrases {
+				if strings.TrimSpace(phrase) == "" {
+					return nil, errors.Errorf("empty phrase of entry %d in %s", i, lang)
+				}
+				c.Entries[i].Phrases[lang][j] = normalize(phrase)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// Load reads catalogue from file at path
+func Load(path string) (*Catalogue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading catalogue")
+	}
+	return Parse(data)
+}
+
+// Classify returns reason of bank error, ok is false when message matches no entry
+func (c *Catalogue) Classify(errorCode int, message string) (reason Reason, ok bool) {
+	message = normalize(message)
+	for _, e := range c.Entries {
+		if !e.appliesTo(errorCode) {
+			continue
+		}
+		for _, phrases := range e.Phrases {
+			for _, phrase := range phrases {
+				if strings.Contains(message, phrase) {
+					return e.Reason, true
+				}
+			}
+		}
+	}
+	return ReasonUnknown, false
+}
+
+func (e Entry) appliesTo(errorCode int) bool {
+	if len(e.ErrorCodes) == 0 {
+		return true
+	}
+	for _, code := range e.ErrorCodes {
+		if code == errorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize lowercases message and folds letters banks spell inconsistently
+func normalize(s string) string {
+	s = strings.ToLower(strings.Join(strings.Fields(s), " "))
+	return strings.ReplaceAll(s, "ё", "е")
+}
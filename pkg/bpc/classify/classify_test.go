@@ -0,0 +1,96 @@
+package classify_test
+
+import (
+	"testing"
+
+	"ykjam/bpchack/pkg/bpc/classify"
+)
+
+func TestDefaultCatalogue(t *testing.T) {
+	tests := []struct {
+		message string
+		want    classify.Reason
+		known   bool
+	}{
+		{"Не указан код CVC2/CVV2", classify.ReasonCVCRequired, true},
+		{"Неизвестная платёжная система", classify.ReasonUnknownPaymentSystem, true},
+		{"Unknown payment system", classify.ReasonUnknownPaymentSystem, true},
+		{"Hasabyňyzda serişde ýeterlik däl", classify.ReasonInsufficientFunds, true},
+		{"Операция отклонена: недостаточно  средств на карте", classify.ReasonInsufficientFunds, true},
+		{"KART PETIKLENEN", classify.ReasonCardBlocked, true},
+		{"Срок действия карты истёк", classify.ReasonCardExpired, true},
+		{"Card is not enrolled in 3-D Secure", classify.ReasonNotEnrolled, true},
+		{"Превышен лимит операций по карте", classify.ReasonLimitExceeded, true},
+		// codes alone used to be taken for cvc errors
+		{"Системная ошибка, код 1001", classify.ReasonUnknown, false},
+	}
+	for _, tt := range tests {
+		reason, known := classify.Default().Classify(1, tt.message)
+		if reason != tt.want || known != tt.known {
+			t.Errorf("Classify(%q) = %s, %v, want %s, %v", tt.message, reason, known, tt.want, tt.known)
+		}
+	}
+}
+
+// messages which checks of processform.do errors classified before the catalogue, by "Payment system",
+// "Неизвестная платёжная система", "CVC" and "код" in message of error code 1, bare words are too broad to keep
+func TestDefaultCatalogueKeepsBaseline(t *testing.T) {
+	tests := []struct {
+		message string
+		want    classify.Reason
+	}{
+		{"Payment system is unknown", classify.ReasonUnknownPaymentSystem},
+		{"Payment system of card is not allowed for merchant", classify.ReasonUnknownPaymentSystem},
+		{"Неизвестная платёжная система", classify.ReasonUnknownPaymentSystem},
+		{"Введите код CVC", classify.ReasonCVCRequired},
+		{"CVC is missing", classify.ReasonCVCRequired},
+		{"Wrong CVC2", classify.ReasonCVCRequired},
+		{"Неверный код", classify.ReasonCVCRequired},
+		{"Введите код безопасности с обратной стороны карты", classify.ReasonCVCRequired},
+		{"Не указан код", classify.ReasonCVCRequired},
+	}
+	for _, tt := range tests {
+		reason, known := classify.Default().Classify(1, tt.message)
+		if reason != tt.want || !known {
+			t.Errorf("Classify(%q) = %s, %v, want %s", tt.message, reason, known, tt.want)
+		}
+	}
+}
+
+// errors of card details are reported with error code 1, declines mentioning cvc or payment system are other errors
+func TestDefaultCatalogueScopesCardDetails(t *testing.T) {
+	tests := []struct {
+		code    int
+		message string
+	}{
+		{5, "Wrong CVC2"},
+		{5, "Операция отклонена, неверный код CVC"},
+		{5, "Payment system is unknown"},
+		{1, "Payment system error"},
+		{1, "CVC"},
+	}
+	for _, tt := range tests {
+		reason, known := classify.Default().Classify(tt.code, tt.message)
+		if reason == classify.ReasonCVCRequired || reason == classify.ReasonUnknownPaymentSystem || known {
+			t.Errorf("Classify(%d, %q) = %s, %v, want unknown", tt.code, tt.message, reason, known)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	c, err := classify.Parse([]byte(`{"entries": [
+		{"reason": "card-blocked", "error_codes": [5], "phrases": {"en": ["Do Not Honor"]}}
+	]}`))
+	if err != nil {
+		t.Fatalf("error parsing catalogue: %v", err)
+	}
+	if reason, _ := c.Classify(5, "do not honor"); reason != classify.ReasonCardBlocked {
+		t.Errorf("reason = %s, want %s", reason, classify.ReasonCardBlocked)
+	}
+	if _, known := c.Classify(1, "do not honor"); known {
+		t.Error("entry of other error code matched")
+	}
+	if _, err = classify.Parse([]byte(`{"entries": [{"reason": "bad-luck", "phrases": {"en": ["x"]}}]}`)); err == nil {
+		t.Error("entry of unknown reason is accepted")
+	}
+}
@@ -0,0 +1,114 @@
+package mock
+
+import "sort"
+
+// Scenario describes how mock MPI and ACS behave for an order
+type Scenario struct {
+	Name string
+	// getSessionStatus.do reports order as expired or already processed
+	SessionExpired bool
+	// getSessionStatus.do responds with 503 to this many first requests of order
+	UnavailableStatusChecks int
+	RemainingSecs           int64
+	Amount                  string
+	// processform.do rejects card without CVC
+	CVCRequired bool
+	// processform.do rejects every card as unknown payment system
+	UnknownPaymentSystem bool
+	// processform.do rejects every card with this error message
+	ProcessFormError string
+	// ACS responds with 503 to this many first authentication requests of order
+	UnavailableACSStarts int
+	// number shown in ACS tip
+	PhoneNumber string
+	// correct one-time password, empty means every password is wrong
+	OTP string
+	// wrong passwords allowed before operation is cancelled
+	PasswordAttempts int
+	ResendAttempts   int
+	// ACS rejects requests without session cookie it set on authentication start
+	RequireACSCookie bool
+	// url TermUrl redirects to after successful payment, {base}/merchant/finish.html by default,
+	// path is relative to mock, paths starting with /merchant/ are served by mock itself
+	FinalUrl string
+	// paid order is only approved, amount is held until merchant deposits it
+	TwoStage bool
+}
+
+const (
+	ScenarioSuccess              = "success"
+	ScenarioSessionExpired       = "expired-session"
+	ScenarioCVCRequired          = "cvc-required"
+	ScenarioUnknownPaymentSystem = "unknown-payment-system"
+	ScenarioWrongOTP             = "wrong-otp"
+	ScenarioOperationCancelled   = "operation-cancelled"
+	ScenarioResendExhausted      = "resend-exhausted"
+	ScenarioInsufficientFunds    = "insufficient-funds"
+	ScenarioTwoStage             = "two-stage"
+)
+
+// DefaultOTP is the correct one-time password in predefined scenarios
+const DefaultOTP = "123456"
+
+var baseScenario = Scenario{
+	RemainingSecs:    1200,
+	Amount:           "10.00 TMT",
+	PhoneNumber:      "+99365XXXX11",
+	OTP:              DefaultOTP,
+	PasswordAttempts: 3,
+	ResendAttempts:   3,
+}
+
+func predefined(name string, modify func(s *Scenario)) Scenario {
+	s := baseScenario
+	s.Name = name
+	if modify != nil {
+		modify(&s)
+	}
+	return s
+}
+
+var scenarios = map[string]Scenario{
+	ScenarioSuccess: predefined(ScenarioSuccess, nil),
+	ScenarioSessionExpired: predefined(ScenarioSessionExpired, func(s *Scenario) {
+		s.SessionExpired = true
+	}),
+	ScenarioCVCRequired: predefined(ScenarioCVCRequired, func(s *Scenario) {
+		s.CVCRequired = true
+	}),
+	ScenarioUnknownPaymentSystem: predefined(ScenarioUnknownPaymentSystem, func(s *Scenario) {
+		s.UnknownPaymentSystem = true
+	}),
+	ScenarioWrongOTP: predefined(ScenarioWrongOTP, func(s *Scenario) {
+		s.OTP = ""
+	}),
+	ScenarioOperationCancelled: predefined(ScenarioOperationCancelled, func(s *Scenario) {
+		s.OTP = ""
+		s.PasswordAttempts = 1
+	}),
+	ScenarioResendExhausted: predefined(ScenarioResendExhausted, func(s *Scenario) {
+		s.ResendAttempts = 0
+	}),
+	ScenarioInsufficientFunds: predefined(ScenarioInsufficientFunds, func(s *Scenario) {
+		s.ProcessFormError = "Недостаточно средств на карте"
+	}),
+	ScenarioTwoStage: predefined(ScenarioTwoStage, func(s *Scenario) {
+		s.TwoStage = true
+	}),
+}
+
+// ScenarioByName returns one of predefined scenarios
+func ScenarioByName(name string) (Scenario, bool) {
+	s, ok := scenarios[name]
+	return s, ok
+}
+
+// ScenarioNames returns names of predefined scenarios
+func ScenarioNames() []string {
+	names := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
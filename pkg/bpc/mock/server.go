@@ -0,0 +1,425 @@
+package mock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+
+	"ykjam/bpchack/pkg/bpc/response"
+)
+
+// MPIPath is path of MPI REST api in mock server, use server url + MPIPath as base mpi url
+const MPIPath = "/payment/rest"
+
+const (
+	acsStartPath   = "/acs/auth/start.do"
+	acsSessionPath = "/acs/auth/otp.do"
+	termPath       = MPIPath + "/finish3ds.do"
+	finalPath      = "/merchant/finish.html"
+)
+
+const acsCookieName = "JSESSIONID"
+
+const (
+	errorUnknownPaymentSystem = "Неизвестная платёжная система"
+	errorCVCRequired          = "Не указан код CVC2/CVV2"
+	errorOrderNotFound        = "Заказ не найден"
+)
+
+// amount of every order, 10.00 TMT in minor units
+const (
+	orderAmount   = 1000
+	orderCurrency = "934"
+)
+
+// action codes of declined orders
+const (
+	actionCodeDeclined      = -2006
+	actionCodeBankRejected  = 116
+	descriptionDeclined     = "3-D Secure authentication failed"
+	descriptionBankRejected = "Insufficient funds"
+)
+
+type order struct {
+	mdOrder      string
+	scenario     Scenario
+	requestId    string
+	acsCookie    string
+	statusChecks int
+	acsStarts    int
+	// password was sent at least once
+	passwordSent   bool
+	resendLeft     int
+	wrongPasswords int
+	cancelled      bool
+	paid           bool
+	// card was accepted by processform.do, ACS authentication is in progress
+	acsStarted bool
+	// processform.do rejected card
+	rejected bool
+}
+
+// Server emulates BPC MPI endpoints (getSessionStatus.do, processform.do, TermUrl, getOrderStatusExtended.do)
+// together with ACS pages, it is an http.Handler, so it can be used with httptest.NewServer
+type Server struct {
+	scenario Scenario
+	mux      *http.ServeMux
+
+	mu       sync.Mutex
+	orders   map[string]*order
+	requests map[string]*order
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{
+		"method": r.Method,
+		"uri":    r.RequestURI,
+	}).Debug("mock request")
+	s.mux.ServeHTTP(w, r)
+}
+
+// Register creates order with scenario, so one server can serve different scenarios at once
+func (s *Server) Register(scenario Scenario) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.newOrder(randomId(), scenario)
+	return o.mdOrder
+}
+
+func (s *Server) newOrder(mdOrder string, scenario Scenario) *order {
+	o := &order{
+		mdOrder:    mdOrder,
+		scenario:   scenario,
+		requestId:  randomId(),
+		acsCookie:  randomId(),
+		resendLeft: scenario.ResendAttempts,
+	}
+	s.orders[mdOrder] = o
+	s.requests[o.requestId] = o
+	return o
+}
+
+// orderByMDOrder returns order, unknown orders are created with server scenario
+func (s *Server) orderByMDOrder(mdOrder string) *order {
+	o, ok := s.orders[mdOrder]
+	if !ok {
+		o = s.newOrder(mdOrder, s.scenario)
+	}
+	return o
+}
+
+func randomId() string {
+	raw := make([]byte, 16)
+	_, _ = rand.Read(raw)
+	h := hex.EncodeToString(raw)
+	// shaped like uuid, the same way as BPC order ids are
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+func baseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func postOnly(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// handleRegister is simplified register.do, returns orderId and formUrl, scenario can be chosen by name
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	scenario := s.scenario
+	if name := r.FormValue("scenario"); name != "" {
+		var ok bool
+		scenario, ok = ScenarioByName(name)
+		if !ok {
+			writeJson(w, map[string]interface{}{"errorCode": "1", "errorMessage": "unknown scenario"})
+			return
+		}
+	}
+	mdOrder := s.Register(scenario)
+	writeJson(w, map[string]string{
+		"orderId": mdOrder,
+		"formUrl": fmt.Sprintf("%s/payment/merchants/mock/payment_ru.html?mdOrder=%s", baseUrl(r), mdOrder),
+	})
+}
+
+func (s *Server) handleSessionStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.orderByMDOrder(r.FormValue("MDORDER"))
+	o.statusChecks++
+	if o.statusChecks <= o.scenario.UnavailableStatusChecks {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if o.scenario.SessionExpired || o.paid || o.cancelled {
+		// BPC responds with almost empty object for expired and processed orders
+		writeJson(w, response.SessionStatus{Redirect: baseUrl(r) + finalPath})
+		return
+	}
+	writeJson(w, response.SessionStatus{
+		RemainingSecs:  o.scenario.RemainingSecs,
+		SessionStatus:  response.SessionStatusCodeZero,
+		OrderNumber:    o.mdOrder[:8],
+		Amount:         o.scenario.Amount,
+		Description:    "mock order",
+		CvcNotRequired: !o.scenario.CVCRequired,
+	})
+}
+
+func (s *Server) handleProcessForm(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.orderByMDOrder(r.FormValue("MDORDER"))
+	if o.scenario.UnknownPaymentSystem {
+		writeJson(w, response.PaymentProcessForm{ErrorCode: 1, Error: errorUnknownPaymentSystem})
+		return
+	}
+	if o.scenario.ProcessFormError != "" {
+		o.rejected = true
+		writeJson(w, response.PaymentProcessForm{ErrorCode: 1, Error: o.scenario.ProcessFormError})
+		return
+	}
+	if o.scenario.CVCRequired && r.FormValue("$CVC") == "" {
+		writeJson(w, response.PaymentProcessForm{ErrorCode: 1, Error: errorCVCRequired})
+		return
+	}
+	o.acsStarted = true
+	base := baseUrl(r)
+	writeJson(w, response.PaymentProcessForm{
+		Info:    "Ваш платёж обработан, происходит переадресация...",
+		ACSUrl:  base + acsStartPath,
+		PaReq:   "pareq-" + o.mdOrder,
+		TermUrl: base + termPath,
+	})
+}
+
+func (s *Server) handleACSStart(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	o, ok := s.orders[r.FormValue("MD")]
+	unavailable := false
+	if ok {
+		o.acsStarts++
+		unavailable = o.acsStarts <= o.scenario.UnavailableACSStarts
+	}
+	s.mu.Unlock()
+	if !ok || r.FormValue("PaReq") != "pareq-"+o.mdOrder || r.FormValue("TermUrl") == "" {
+		http.Error(w, "invalid authentication request", http.StatusBadRequest)
+		return
+	}
+	if unavailable {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: acsCookieName, Value: o.acsCookie, Path: "/acs", HttpOnly: true})
+	http.Redirect(w, r, acsSessionPath+"?request_id="+url.QueryEscape(o.requestId), http.StatusFound)
+}
+
+type acsPage struct {
+	RequestId     string
+	PhoneNumber   string
+	ResendLeft    int
+	ShowResend    bool
+	WrongAttempt  int
+	TotalAttempts int
+	Cancelled     bool
+	MDOrder       string
+	PaRes         string
+	TermUrl       string
+}
+
+var acsTemplate = template.Must(template.New("acs").Parse(`<!DOCTYPE html>
+<html>
+<head><title>3-D Secure</title></head>
+<body>
+{{- if .PaRes }}
+<form id="paResForm" method="post" action="{{ .TermUrl }}">
+<input type="hidden" name="MD" value="{{ .MDOrder }}" />
+<input type="hidden" name="PaRes" value="{{ .PaRes }}" />
+</form>
+<script>document.getElementById('paResForm').submit();</script>
+{{- else if .Cancelled }}
+<span class="operationCancelledMessage">Operation cancelled</span>
+{{- else }}
+<form id="authForm" name="authForm" method="post">
+<input type="hidden" name="request_id" value="{{ .RequestId }}" />
+<div id="tipContainer" class="tipContainer"><span class="tip">One-time password will be sent to number {{ .PhoneNumber }}</span></div>
+{{- if .WrongAttempt }}
+<div id="errorContainer" class="errorContainer"><ul><li class="errorMessage">	Wrong password typed attempt {{ .WrongAttempt }} of {{ .TotalAttempts }} </li></ul></div>
+{{- end }}
+<input id="pwdInputVisible" type="password" name="pwdInputVisible" />
+{{- if .ShowResend }}
+<a id="resendPasswordLink" href="#" title="{{ .ResendLeft }} password send attempt(s) left" onclick="jsf.util.chain(this,event);return false">Resend password</a>
+{{- end }}
+<input type="submit" name="submitPasswordButton" value="Submit" />
+</form>
+{{- end }}
+</body>
+</html>
+`))
+
+func (s *Server) handleACSSession(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.requests[r.FormValue("request_id")]
+	if !ok {
+		http.Error(w, "unknown request", http.StatusBadRequest)
+		return
+	}
+	if o.scenario.RequireACSCookie {
+		if c, err := r.Cookie(acsCookieName); err != nil || c.Value != o.acsCookie {
+			http.Error(w, "session cookie missing", http.StatusForbidden)
+			return
+		}
+	}
+	page := acsPage{
+		RequestId:   o.requestId,
+		PhoneNumber: o.scenario.PhoneNumber,
+		MDOrder:     o.mdOrder,
+		Cancelled:   o.cancelled,
+	}
+	if r.Method == http.MethodPost && !o.cancelled {
+		switch {
+		case r.FormValue("sendPasswordButton") != "":
+			o.passwordSent = true
+		case r.FormValue("resendPasswordLink") != "":
+			if o.resendLeft > 0 {
+				o.resendLeft--
+			}
+		case r.FormValue("submitPasswordButton") != "":
+			password := r.FormValue("pwdInputVisible")
+			if o.scenario.OTP != "" && password == o.scenario.OTP {
+				page.PaRes = "pares-" + o.mdOrder
+				page.TermUrl = baseUrl(r) + termPath
+			} else {
+				o.wrongPasswords++
+				if o.wrongPasswords >= o.scenario.PasswordAttempts {
+					o.cancelled = true
+					page.Cancelled = true
+				} else {
+					page.WrongAttempt = o.wrongPasswords
+					page.TotalAttempts = o.scenario.PasswordAttempts
+				}
+			}
+		}
+	}
+	page.ShowResend = o.passwordSent && o.resendLeft > 0
+	page.ResendLeft = o.resendLeft
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	err := acsTemplate.Execute(w, page)
+	if err != nil {
+		log.WithError(err).Error("error rendering acs page")
+	}
+}
+
+func (s *Server) handleTerm(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[r.FormValue("MD")]
+	if !ok || r.FormValue("PaRes") != "pares-"+o.mdOrder {
+		http.Error(w, "invalid payment response", http.StatusBadRequest)
+		return
+	}
+	o.paid = true
+	finalUrl := o.scenario.FinalUrl
+	if finalUrl == "" {
+		finalUrl = baseUrl(r) + finalPath
+	} else if strings.HasPrefix(finalUrl, "/") {
+		finalUrl = baseUrl(r) + finalUrl
+	}
+	if strings.Contains(finalUrl, "?") {
+		finalUrl += "&orderId=" + url.QueryEscape(o.mdOrder)
+	} else {
+		finalUrl += "?orderId=" + url.QueryEscape(o.mdOrder)
+	}
+	http.Redirect(w, r, finalUrl, http.StatusFound)
+}
+
+// handleOrderStatus is simplified getOrderStatusExtended.do, merchant credentials are not checked
+func (s *Server) handleOrderStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[r.FormValue("orderId")]
+	if !ok {
+		writeJson(w, map[string]interface{}{"errorCode": "6", "errorMessage": errorOrderNotFound})
+		return
+	}
+	status := response.OrderStatusRegistered
+	resp := response.OrderStatusExtended{
+		OrderNumber: o.mdOrder[:8],
+		Amount:      orderAmount,
+		Currency:    orderCurrency,
+	}
+	switch {
+	case o.paid && o.scenario.TwoStage:
+		status = response.OrderStatusApproved
+		resp.PaymentAmountInfo = response.PaymentAmountInfo{PaymentState: "APPROVED", ApprovedAmount: orderAmount}
+	case o.paid:
+		status = response.OrderStatusDeposited
+		resp.PaymentAmountInfo = response.PaymentAmountInfo{PaymentState: "DEPOSITED", ApprovedAmount: orderAmount, DepositedAmount: orderAmount}
+	case o.cancelled:
+		status = response.OrderStatusDeclined
+		resp.ActionCode = actionCodeDeclined
+		resp.ActionCodeDescription = descriptionDeclined
+		resp.PaymentAmountInfo.PaymentState = "DECLINED"
+	case o.rejected:
+		status = response.OrderStatusDeclined
+		resp.ActionCode = actionCodeBankRejected
+		resp.ActionCodeDescription = descriptionBankRejected
+		resp.PaymentAmountInfo.PaymentState = "DECLINED"
+	case o.acsStarted:
+		status = response.OrderStatusACSAuthInitiated
+		resp.PaymentAmountInfo.PaymentState = "STARTED"
+	default:
+		resp.PaymentAmountInfo.PaymentState = "CREATED"
+	}
+	resp.OrderStatus = &status
+	writeJson(w, resp)
+}
+
+func handleFinal(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	_, _ = fmt.Fprintln(w, "<html><body>Payment complete</body></html>")
+}
+
+// NewServer returns mock server, orders not registered with Server.Register follow scenario
+func NewServer(scenario Scenario) *Server {
+	s := &Server{
+		scenario: scenario,
+		mux:      http.NewServeMux(),
+		orders:   make(map[string]*order),
+		requests: make(map[string]*order),
+	}
+	s.mux.HandleFunc(MPIPath+"/register.do", postOnly(s.handleRegister))
+	s.mux.HandleFunc(MPIPath+"/getSessionStatus.do", postOnly(s.handleSessionStatus))
+	s.mux.HandleFunc(MPIPath+"/processform.do", postOnly(s.handleProcessForm))
+	s.mux.HandleFunc(MPIPath+"/getOrderStatusExtended.do", postOnly(s.handleOrderStatus))
+	s.mux.HandleFunc(termPath, postOnly(s.handleTerm))
+	s.mux.HandleFunc(acsStartPath, postOnly(s.handleACSStart))
+	s.mux.HandleFunc(acsSessionPath, s.handleACSSession)
+	// every merchant page, final url of scenario may point to any of them
+	s.mux.HandleFunc("/merchant/", handleFinal)
+	return s
+}
@@ -0,0 +1,64 @@
+package response
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// OrderStatusExtended is response of getOrderStatusExtended.do
+type OrderStatusExtended struct {
+	// zero if order was found, the rest of fields are empty otherwise
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+	OrderNumber  string    `json:"orderNumber,omitempty"`
+	// missing when order was not found
+	OrderStatus *OrderStatusCode `json:"orderStatus,omitempty"`
+	// result of authorization given by processing, zero if approved
+	ActionCode            int    `json:"actionCode"`
+	ActionCodeDescription string `json:"actionCodeDescription,omitempty"`
+	// in minor units of currency
+	Amount int64 `json:"amount"`
+	// ISO 4217 numeric code, e.g. "934"
+	Currency          string            `json:"currency,omitempty"`
+	PaymentAmountInfo PaymentAmountInfo `json:"paymentAmountInfo"`
+}
+
+type PaymentAmountInfo struct {
+	PaymentState    string `json:"paymentState,omitempty"`
+	ApprovedAmount  int64  `json:"approvedAmount"`
+	DepositedAmount int64  `json:"depositedAmount"`
+	RefundedAmount  int64  `json:"refundedAmount"`
+}
+
+type OrderStatusCode int
+
+const (
+	OrderStatusRegistered OrderStatusCode = 0
+	// amount is held on card, but not deposited yet
+	OrderStatusApproved         OrderStatusCode = 1
+	OrderStatusDeposited        OrderStatusCode = 2
+	OrderStatusReversed         OrderStatusCode = 3
+	OrderStatusRefunded         OrderStatusCode = 4
+	OrderStatusACSAuthInitiated OrderStatusCode = 5
+	// authorization declined, see action code for reason
+	OrderStatusDeclined OrderStatusCode = 6
+)
+
+// ErrorCode is sent as string by some installations and as number by others
+type ErrorCode int
+
+func (c *ErrorCode) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*c = 0
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.Errorf("error code is not a number: %s", data)
+	}
+	*c = ErrorCode(n)
+	return nil
+}
@@ -0,0 +1,218 @@
+package pkg
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BreakerConfig configures circuit breaker of every bank MPI host
+type BreakerConfig struct {
+	// share of failed requests within Window which opens breaker, zero disables breakers
+	FailureRatio float64
+	// breaker does not open until this many requests were made within Window
+	MinRequests int
+	Window      time.Duration
+	// open breaker lets probe requests through after this duration
+	OpenTimeout time.Duration
+	// concurrent probe requests allowed while breaker is half-open
+	HalfOpenProbes int
+}
+
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureRatio:   0.5,
+		MinRequests:    10,
+		Window:         30 * time.Second,
+		OpenTimeout:    30 * time.Second,
+		HalfOpenProbes: 1,
+	}
+}
+
+type BreakerStateName string
+
+const (
+	BreakerClosed   BreakerStateName = "closed"
+	BreakerOpen     BreakerStateName = "open"
+	BreakerHalfOpen BreakerStateName = "half-open"
+)
+
+// BreakerState is snapshot of circuit breaker of MPI host
+type BreakerState struct {
+	Host  string           `json:"host"`
+	Banks []string         `json:"banks"`
+	State BreakerStateName `json:"state"`
+	// requests and failures within current window
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+	// when breaker was opened and when it lets probes through, unix seconds
+	OpenedTs int64 `json:"opened-ts,omitempty"`
+	ProbeTs  int64 `json:"probe-ts,omitempty"`
+}
+
+type InspectBreakersResponse struct {
+	Breakers []BreakerState `json:"breakers"`
+}
+
+// ErrBankUnavailable is returned when breaker of bank MPI host is open
+var ErrBankUnavailable = errors.New("bank is unavailable, circuit breaker is open")
+
+// breaker is circuit breaker of single MPI host, counting requests in fixed windows
+type breaker struct {
+	config BreakerConfig
+	host   string
+	banks  []string
+
+	mu          sync.Mutex
+	state       BreakerStateName
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+}
+
+func newBreaker(config BreakerConfig, host string) *breaker {
+	return &breaker{config: config, host: host, state: BreakerClosed}
+}
+
+// allow reports whether request to host may be made, allowed request must be followed by done
+func (b *breaker) allow() bool {
+	if b == nil || b.config.FailureRatio <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.state == BreakerOpen {
+		if now.Sub(b.openedAt) < b.config.OpenTimeout {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probes = 0
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.config.HalfOpenProbes {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// done records outcome of allowed request
+func (b *breaker) done(err error) {
+	if b == nil || b.config.FailureRatio <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if errors.Is(err, context.Canceled) {
+		// client went away, nothing is known about bank
+		if b.state == BreakerHalfOpen && b.probes > 0 {
+			b.probes--
+		}
+		return
+	}
+	failed := isBankFailure(err)
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.state = BreakerOpen
+			b.openedAt = now
+			return
+		}
+		b.state = BreakerClosed
+		b.resetWindow(now)
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.config.Window {
+			b.resetWindow(now)
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.config.MinRequests &&
+			float64(b.failures) >= b.config.FailureRatio*float64(b.requests) {
+			b.state = BreakerOpen
+			b.openedAt = now
+		}
+	}
+}
+
+func (b *breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+func (b *breaker) snapshot() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := BreakerState{
+		Host:     b.host,
+		Banks:    b.banks,
+		State:    b.state,
+		Requests: b.requests,
+		Failures: b.failures,
+	}
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.config.OpenTimeout {
+		// the next request is a probe
+		state.State = BreakerHalfOpen
+	}
+	if b.state != BreakerClosed {
+		state.OpenedTs = b.openedAt.Unix()
+		state.ProbeTs = b.openedAt.Add(b.config.OpenTimeout).Unix()
+	}
+	return state
+}
+
+// isBankFailure reports whether err means bank is unreachable or broken,
+// answers of bank and refusals of bpchack itself are not failures
+func isBankFailure(err error) bool {
+	if err == nil || errors.Is(err, ErrDestinationRejected) {
+		return false
+	}
+	var network *NetworkError
+	if errors.As(err, &network) {
+		return true
+	}
+	var unexpected *UnexpectedStatusError
+	return errors.As(err, &unexpected) && unexpected.Code >= 500
+}
+
+// newBreakers creates breaker per MPI host, banks sharing host share breaker
+func newBreakers(config BreakerConfig, banks []BankProfile) map[string]*breaker {
+	breakers := make(map[string]*breaker)
+	for i := range banks {
+		u, err := url.Parse(banks[i].BaseMpiUrl)
+		if err != nil {
+			continue
+		}
+		host := u.Host
+		b, ok := breakers[host]
+		if !ok {
+			b = newBreaker(config, host)
+			breakers[host] = b
+		}
+		b.banks = append(b.banks, banks[i].Name)
+		banks[i].breaker = b
+	}
+	return breakers
+}
+
+func (s *service) InspectBreakers(_ context.Context) (resp InspectBreakersResponse, err error) {
+	resp.Breakers = make([]BreakerState, 0, len(s.breakers))
+	for _, b := range s.breakers {
+		resp.Breakers = append(resp.Breakers, b.snapshot())
+	}
+	sort.Slice(resp.Breakers, func(i, j int) bool {
+		return resp.Breakers[i].Host < resp.Breakers[j].Host
+	})
+	return
+}
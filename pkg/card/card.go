@@ -0,0 +1,172 @@
+// Package card validates card details before they are submitted to bank.
+package card
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PaymentSystem string
+
+const (
+	PaymentSystemVisa       PaymentSystem = "visa"
+	PaymentSystemMastercard PaymentSystem = "mastercard"
+	// national payment system of Turkmenistan
+	PaymentSystemAltynAsyr PaymentSystem = "altyn-asyr"
+	PaymentSystemUnknown   PaymentSystem = "unknown"
+)
+
+// fields of card details, named as json fields of submit card request
+const (
+	FieldNumber     = "card-number"
+	FieldExpiry     = "card-expiry"
+	FieldNameOnCard = "name-on-card"
+	FieldCVC        = "card-cvc"
+)
+
+// machine-readable codes of ValidationError
+const (
+	CodeInvalidNumber     = "invalid-card-number"
+	CodeInvalidChecksum   = "invalid-card-checksum"
+	CodeInvalidExpiry     = "invalid-card-expiry"
+	CodeCardExpired       = "card-expired"
+	CodeInvalidNameOnCard = "invalid-name-on-card"
+	CodeInvalidCVC        = "invalid-card-cvc"
+)
+
+// cards are not issued for longer than this, expiry further away is a typo
+const maxValidity = 20
+
+var (
+	rNumber       = regexp.MustCompile(`^[0-9]{13,19}$`)
+	rExpiryYYYYMM = regexp.MustCompile(`^([0-9]{4})([0-9]{2})$`)
+	rExpiryMMYY   = regexp.MustCompile(`^([0-9]{2})/?([0-9]{2})$`)
+	rCVC          = regexp.MustCompile(`^[0-9]{3,4}$`)
+)
+
+// ValidationError tells which field of card details is not valid and why
+type ValidationError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// Details of card, as they are submitted to bank
+type Details struct {
+	Number string
+	// YYYYMM
+	Expiry        string
+	NameOnCard    string
+	CVC           string
+	PaymentSystem PaymentSystem
+}
+
+// Validate checks card details, entered by cardholder, at time now.
+// Expiry is accepted as YYYYMM, MMYY or MM/YY and normalized to YYYYMM, CVC may be empty.
+// Cards of payment systems not known here are left to bank to accept or reject
+func Validate(number, expiry, nameOnCard, cvc string, now time.Time) (d Details, err error) {
+	if !rNumber.MatchString(number) {
+		return d, &ValidationError{FieldNumber, CodeInvalidNumber, "card number must be 13 to 19 digits"}
+	}
+	if !Luhn(number) {
+		return d, &ValidationError{FieldNumber, CodeInvalidChecksum, "card number checksum is not valid"}
+	}
+	d.Number = number
+	d.PaymentSystem = PaymentSystemOf(number)
+	d.Expiry, err = ParseExpiry(expiry, now)
+	if err != nil {
+		return d, err
+	}
+	if len(nameOnCard) < 4 || len(nameOnCard) > 32 {
+		return d, &ValidationError{FieldNameOnCard, CodeInvalidNameOnCard, "name on card must be 4 to 32 characters"}
+	}
+	d.NameOnCard = nameOnCard
+	if cvc != "" && !rCVC.MatchString(cvc) {
+		return d, &ValidationError{FieldCVC, CodeInvalidCVC, "cvc must be 3 or 4 digits"}
+	}
+	d.CVC = cvc
+	return d, nil
+}
+
+// Luhn reports whether digits pass Luhn checksum
+func Luhn(digits string) bool {
+	if digits == "" {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		c := digits[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		n := int(c - '0')
+		if double {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// PaymentSystemOf detects payment system by BIN range of card number
+func PaymentSystemOf(number string) PaymentSystem {
+	switch {
+	case strings.HasPrefix(number, "4"):
+		return PaymentSystemVisa
+	case inRange(number, 2, 51, 55), inRange(number, 4, 2221, 2720):
+		return PaymentSystemMastercard
+	case strings.HasPrefix(number, "9934"):
+		return PaymentSystemAltynAsyr
+	}
+	return PaymentSystemUnknown
+}
+
+// inRange reports whether first n digits of number are within [from, to]
+func inRange(number string, n, from, to int) bool {
+	if len(number) < n {
+		return false
+	}
+	prefix, err := strconv.Atoi(number[:n])
+	if err != nil {
+		return false
+	}
+	return prefix >= from && prefix <= to
+}
+
+// ParseExpiry parses expiry written as YYYYMM, MMYY or MM/YY and returns it as YYYYMM.
+// Card is valid through the last day of expiry month
+func ParseExpiry(expiry string, now time.Time) (string, error) {
+	var year, month int
+	if m := rExpiryYYYYMM.FindStringSubmatch(expiry); m != nil {
+		year, _ = strconv.Atoi(m[1])
+		month, _ = strconv.Atoi(m[2])
+	} else if m = rExpiryMMYY.FindStringSubmatch(expiry); m != nil {
+		month, _ = strconv.Atoi(m[1])
+		year, _ = strconv.Atoi(m[2])
+		year += now.Year() / 100 * 100
+	} else {
+		return "", &ValidationError{FieldExpiry, CodeInvalidExpiry, "expiry must be YYYYMM, MMYY or MM/YY"}
+	}
+	if month < 1 || month > 12 {
+		return "", &ValidationError{FieldExpiry, CodeInvalidExpiry, "expiry month is not valid"}
+	}
+	if year*12+month < now.Year()*12+int(now.Month()) {
+		return "", &ValidationError{FieldExpiry, CodeCardExpired, "card is expired"}
+	}
+	if year > now.Year()+maxValidity {
+		return "", &ValidationError{FieldExpiry, CodeInvalidExpiry, "expiry year is too far in future"}
+	}
+	return fmt.Sprintf("%04d%02d", year, month), nil
+}
@@ -0,0 +1,56 @@
+package card_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"ykjam/bpchack/pkg/card"
+)
+
+func TestValidate(t *testing.T) {
+	now := time.Date(2026, time.March, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		number string
+		expiry string
+		cvc    string
+		code   string
+		system card.PaymentSystem
+		want   string
+	}{
+		{"visa with YYYYMM", "4111111111111111", "203012", "123", "", card.PaymentSystemVisa, "203012"},
+		{"mastercard with MMYY", "5555555555554444", "1228", "", "", card.PaymentSystemMastercard, "202812"},
+		{"mastercard 2-series with MM/YY", "2223003122003222", "03/26", "", "", card.PaymentSystemMastercard, "202603"},
+		{"altyn asyr", "9934000000000002", "202704", "", "", card.PaymentSystemAltynAsyr, "202704"},
+		{"visa of 13 digits", "4222222222222", "202704", "", "", card.PaymentSystemVisa, "202704"},
+		{"longer number", "41111111111111111111", "203012", "", card.CodeInvalidNumber, "", ""},
+		{"number with letters", "4111x11111111111", "203012", "", card.CodeInvalidNumber, "", ""},
+		{"checksum", "4111111111111112", "203012", "", card.CodeInvalidChecksum, "", ""},
+		{"unknown payment system left to bank", "6011111111111117", "203012", "", "", card.PaymentSystemUnknown, "203012"},
+		{"expired last month", "4111111111111111", "202602", "", card.CodeCardExpired, "", ""},
+		{"expiry month", "4111111111111111", "202613", "", card.CodeInvalidExpiry, "", ""},
+		{"expiry format", "4111111111111111", "2030-12", "", card.CodeInvalidExpiry, "", ""},
+		{"expiry too far", "4111111111111111", "209912", "", card.CodeInvalidExpiry, "", ""},
+		{"cvc of 4 digits", "4111111111111111", "203012", "1234", "", card.PaymentSystemVisa, "203012"},
+		{"cvc", "4111111111111111", "203012", "12345", card.CodeInvalidCVC, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := card.Validate(tt.number, tt.expiry, "TEST CARDHOLDER", tt.cvc, now)
+			if tt.code != "" {
+				var vErr *card.ValidationError
+				if !errors.As(err, &vErr) || vErr.Code != tt.code {
+					t.Fatalf("error = %v, want %s", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if d.PaymentSystem != tt.system || d.Expiry != tt.want {
+				t.Errorf("details = %+v, want %s expiring %s", d, tt.system, tt.want)
+			}
+		})
+	}
+}
@@ -6,22 +6,44 @@ type ConfirmPaymentRequest struct {
 	// application trying to use bpc hack, for information purpose only
 	Application string `json:"application"`
 	// to identify each user's request one from another
-	Identity        string `json:"identity"`
-	MDOrder         string `json:"md_order"`
+	Identity string `json:"identity"`
+	// session token received in start hack, when given MDOrder, ACS parameters and TerminateUrl are taken from session
+	Token           string `json:"token,omitempty"`
+	MDOrder         string `json:"md-order"`
 	ACSRequestId    string `json:"acs-request-id"`
 	ACSSessionUrl   string `json:"acs-session-url,omitempty"`
 	OneTimePassword string `json:"one-time-password"`
 	TerminateUrl    string `json:"terminate-url"`
 }
 
+// fields returns values of request by json name, for validation
+func (r ConfirmPaymentRequest) fields() map[string]string {
+	return map[string]string{
+		"application":       r.Application,
+		"identity":          r.Identity,
+		"token":             r.Token,
+		"md-order":          r.MDOrder,
+		"acs-request-id":    r.ACSRequestId,
+		"acs-session-url":   r.ACSSessionUrl,
+		"one-time-password": r.OneTimePassword,
+		"terminate-url":     r.TerminateUrl,
+	}
+}
+
 type ConfirmPaymentResponse struct {
 	Status         HackResponseStatus `json:"status"`
 	CurrentAttempt int                `json:"current-attempt,omitempty"`
 	TotalAttempts  int                `json:"total-attempts,omitempty"`
 	FinalUrl       string             `json:"final-url,omitempty"`
+	// final url classified, given together with it, status stays ok when result is failure
+	Outcome *PaymentOutcome `json:"outcome,omitempty"`
 }
 
 func (s *ConfirmPaymentResponse) String() string {
-	return fmt.Sprintf("ConfirmPaymentResponse {status: %v, cur: %d, tot: %d, finalUrl: %v}",
-		s.Status, s.CurrentAttempt, s.TotalAttempts, s.FinalUrl)
+	result := PaymentResult("")
+	if s.Outcome != nil {
+		result = s.Outcome.Result
+	}
+	return fmt.Sprintf("ConfirmPaymentResponse {status: %v, cur: %d, tot: %d, finalUrl: %v, result: %s}",
+		s.Status, s.CurrentAttempt, s.TotalAttempts, s.FinalUrl, result)
 }
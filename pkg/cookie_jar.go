@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SessionCookie is a cookie set by bank (MPI or ACS) during payment, kept with session between steps
+type SessionCookie struct {
+	// url of response which set the cookie
+	Url      string    `json:"url"`
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Path     string    `json:"path,omitempty"`
+	Domain   string    `json:"domain,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http-only,omitempty"`
+}
+
+func (c *SessionCookie) httpCookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Path:     c.Path,
+		Domain:   c.Domain,
+		Expires:  c.Expires,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+	}
+}
+
+func (c *SessionCookie) isExpired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+// paymentJar is http.CookieJar of a single payment flow, in addition to regular jar it remembers
+// cookies as they were set, so they can be exported to session and restored in next step
+type paymentJar struct {
+	jar *cookiejar.Jar
+
+	mu      sync.Mutex
+	cookies []SessionCookie
+}
+
+func (p *paymentJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	p.jar.SetCookies(u, cookies)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	origin := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	now := time.Now()
+	for _, c := range cookies {
+		sc := SessionCookie{
+			Url:      origin.String(),
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		if c.MaxAge > 0 {
+			sc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		} else if c.MaxAge < 0 {
+			sc.Expires = now
+		} else if !c.Expires.IsZero() {
+			sc.Expires = c.Expires
+		}
+		p.remember(sc, now)
+	}
+}
+
+// remember replaces cookie with the same host, name, domain and path, expired cookies are forgotten
+func (p *paymentJar) remember(sc SessionCookie, now time.Time) {
+	host := hostOf(sc.Url)
+	kept := p.cookies[:0]
+	for _, existing := range p.cookies {
+		if existing.Name == sc.Name && existing.Domain == sc.Domain && existing.Path == sc.Path &&
+			hostOf(existing.Url) == host {
+			continue
+		}
+		kept = append(kept, existing)
+	}
+	p.cookies = kept
+	if !sc.isExpired(now) {
+		p.cookies = append(p.cookies, sc)
+	}
+}
+
+func hostOf(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func (p *paymentJar) Cookies(u *url.URL) []*http.Cookie {
+	return p.jar.Cookies(u)
+}
+
+// Export returns cookies to be kept with session
+func (p *paymentJar) Export() []SessionCookie {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	exported := make([]SessionCookie, 0, len(p.cookies))
+	for _, c := range p.cookies {
+		if !c.isExpired(now) {
+			exported = append(exported, c)
+		}
+	}
+	return exported
+}
+
+// newPaymentJar returns jar containing cookies exported from previous steps
+func newPaymentJar(cookies []SessionCookie) *paymentJar {
+	// error is returned only for invalid options
+	jar, _ := cookiejar.New(nil)
+	p := &paymentJar{jar: jar}
+	for _, c := range cookies {
+		u, err := url.Parse(c.Url)
+		if err != nil {
+			continue
+		}
+		p.SetCookies(u, []*http.Cookie{c.httpCookie()})
+	}
+	return p
+}
@@ -0,0 +1,219 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"ykjam/bpchack/pkg/bpc/acs"
+	"ykjam/bpchack/pkg/bpc/classify"
+)
+
+// Step names workflow step of the service
+type Step string
+
+const (
+	StepStartHack      Step = "start-hack"
+	StepSubmitCard     Step = "submit-card"
+	StepResendCode     Step = "resend-code"
+	StepConfirmPayment Step = "confirm-payment"
+	StepOrderStatus    Step = "order-status"
+)
+
+// parts of workflow steps, each part is a single request to bank or preparation for it
+const (
+	PartRequest           = "request"
+	PartPaymentUrl        = "payment-url"
+	PartSession           = "session"
+	PartBank              = "bank"
+	PartDestination       = "destination"
+	PartSessionStatus     = "session-status"
+	PartProcessForm       = "process-form"
+	PartACSStart          = "acs-start"
+	PartACSSendPassword   = "acs-send-password"
+	PartACSResendPassword = "acs-resend-password"
+	PartACSSubmitPassword = "acs-submit-password"
+	PartCompleteOperation = "complete-operation"
+	PartOrderStatus       = "order-status"
+)
+
+// OperationError tells which step and part of the workflow failed
+type OperationError struct {
+	Step Step
+	Part string
+	Err  error
+}
+
+func (e *OperationError) Error() string {
+	if e.Part == "" {
+		return fmt.Sprintf("%s: %v", e.Step, e.Err)
+	}
+	return fmt.Sprintf("%s, %s: %v", e.Step, e.Part, e.Err)
+}
+
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+// Cause makes OperationError transparent for errors.Cause of github.com/pkg/errors
+func (e *OperationError) Cause() error {
+	return e.Err
+}
+
+// operationError wraps err of step, nil stays nil
+func operationError(step Step, part string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OperationError{Step: step, Part: part, Err: err}
+}
+
+// pages of bank responses referred by ParseError
+const (
+	PageSessionStatus = "session-status"
+	PageProcessForm   = "process-form"
+	PageACS           = "acs"
+	PageOrderStatus   = "order-status"
+)
+
+var ErrWrongPasswordOperationCancelled = errors.New("wrong password, operation cancelled")
+
+// NetworkError means bank could not be reached or connection broke while reading response
+type NetworkError struct {
+	Url string
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("network error requesting %s: %v", e.Url, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// UnexpectedStatusError means bank responded with http status other than 200
+type UnexpectedStatusError struct {
+	Url  string
+	Code int
+}
+
+func (e *UnexpectedStatusError) Error() string {
+	return fmt.Sprintf("unexpected http status %d from %s", e.Code, e.Url)
+}
+
+// ParseError means response of bank could not be understood, Field is empty if whole page is malformed
+type ParseError struct {
+	Page  string
+	Field string
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("error parsing %s page: %v", e.Page, e.Err)
+	}
+	return fmt.Sprintf("error parsing %s of %s page: %v", e.Field, e.Page, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// acsParseError tells which field of ACS page is missing or malformed
+func acsParseError(err error) *ParseError {
+	parseErr := &ParseError{Page: PageACS, Err: err}
+	var notFound *acs.FieldNotFoundError
+	var malformed *acs.MalformedFieldError
+	if errors.As(err, &notFound) {
+		parseErr.Field = string(notFound.Field)
+	} else if errors.As(err, &malformed) {
+		parseErr.Field = string(malformed.Field)
+	}
+	return parseErr
+}
+
+// BankRejectedError is error reported by bank in its response, e.g. card is not accepted
+type BankRejectedError struct {
+	Code    int
+	Message string
+	// classified by catalogue of service, builtin catalogue is used if empty
+	Reason classify.Reason
+}
+
+func (e *BankRejectedError) Error() string {
+	return fmt.Sprintf("bank rejected request, code %d: %s", e.Code, e.Message)
+}
+
+func (e *BankRejectedError) status() HackResponseStatus {
+	reason := e.Reason
+	if reason == "" {
+		reason, _ = classify.Default().Classify(e.Code, e.Message)
+	}
+	switch reason {
+	case classify.ReasonUnknownPaymentSystem:
+		return HackResponseStatusInvalidCard
+	case classify.ReasonCVCRequired:
+		return HackResponseStatusSpecifyCVC
+	case classify.ReasonInsufficientFunds:
+		return HackResponseStatusInsufficientFunds
+	case classify.ReasonCardBlocked:
+		return HackResponseStatusCardBlocked
+	case classify.ReasonCardExpired:
+		return HackResponseStatusCardExpired
+	case classify.ReasonNotEnrolled:
+		return HackResponseStatusNotEnrolled
+	case classify.ReasonLimitExceeded:
+		return HackResponseStatusLimitExceeded
+	default:
+		return HackResponseStatusOtherError
+	}
+}
+
+// SessionExpiredError means bank reports order as expired or already processed
+type SessionExpiredError struct {
+	MDOrder string
+}
+
+func (e *SessionExpiredError) Error() string {
+	return fmt.Sprintf("session of order %s expired or order is already processed", e.MDOrder)
+}
+
+// StatusFromError returns status of response for error returned by service
+func StatusFromError(err error) HackResponseStatus {
+	var expired *SessionExpiredError
+	var rejected *BankRejectedError
+	var network *NetworkError
+	var invalid *ValidationError
+	switch {
+	case err == nil:
+		return HackResponseStatusOk
+	case errors.As(err, &invalid), errors.Is(err, ErrSessionRequired):
+		return HackResponseStatusInvalidRequest
+	case errors.Is(err, ErrDestinationRejected):
+		return HackResponseStatusRejectedDestination
+	case errors.Is(err, ErrUnknownBank):
+		return HackResponseStatusUnknownBank
+	case errors.Is(err, ErrBankUnavailable):
+		return HackResponseStatusBankUnavailable
+	case errors.Is(err, ErrSessionNotFound), errors.Is(err, ErrPaymentCompleted), errors.As(err, &expired):
+		return HackResponseStatusAlreadyProcessed
+	case errors.Is(err, ErrWrongPasswordOperationCancelled):
+		return HackResponseStatusOperationCancelled
+	case errors.As(err, &rejected):
+		return rejected.status()
+	case errors.As(err, &network):
+		return HackResponseStatusNetworkError
+	default:
+		return HackResponseStatusOtherError
+	}
+}
+
+// IsBankAnswer reports whether err is a regular answer of bank about the payment,
+// which clients get as response status, rather than failure to process the payment
+func IsBankAnswer(err error) bool {
+	var expired *SessionExpiredError
+	var rejected *BankRejectedError
+	return errors.As(err, &expired) || errors.As(err, &rejected) ||
+		errors.Is(err, ErrWrongPasswordOperationCancelled)
+}
@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+var ErrDestinationRejected = errors.New("destination rejected")
+
+// addresses bpchack never connects to unless network is explicitly allowed by bank profile,
+// in addition to loopback, private, link-local, multicast and unspecified addresses
+var restrictedNetworks = mustParseNetworks(
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+)
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	networks, err := parseNetworks(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %s", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isRestrictedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range restrictedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationPolicy decides where requests of a bank flow may go
+type destinationPolicy struct {
+	hosts    []string
+	networks []*net.IPNet
+}
+
+func newDestinationPolicy(bank *BankProfile) (*destinationPolicy, error) {
+	networks, err := parseNetworks(bank.AllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	return &destinationPolicy{
+		hosts:    bank.destinationHosts(),
+		networks: networks,
+	}, nil
+}
+
+// allowsIP reports whether connection to ip is allowed, public addresses are always allowed
+func (p *destinationPolicy) allowsIP(ip net.IP) bool {
+	if !isRestrictedIP(ip) {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUrl verifies url given by client or bank points to one of allowed hosts
+func (p *destinationPolicy) checkUrl(rawUrl string) error {
+	if p == nil {
+		return errors.Wrap(ErrDestinationRejected, "no destination policy")
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return errors.Wrapf(ErrDestinationRejected, "invalid url: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.Wrapf(ErrDestinationRejected, "scheme %q is not allowed", u.Scheme)
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil && !p.allowsIP(ip) {
+		return errors.Wrapf(ErrDestinationRejected, "address %s is not allowed", ip)
+	}
+	for _, pattern := range p.hosts {
+		if matchHost(pattern, host) {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrDestinationRejected, "host %s is not allowed", host)
+}
+
+type destinationPolicyKey struct{}
+
+func withDestinationPolicy(ctx context.Context, p *destinationPolicy) context.Context {
+	return context.WithValue(ctx, destinationPolicyKey{}, p)
+}
+
+func destinationPolicyFromContext(ctx context.Context) *destinationPolicy {
+	p, _ := ctx.Value(destinationPolicyKey{}).(*destinationPolicy)
+	return p
+}
+
+// guardedDialContext checks every address right before connecting, after name resolution,
+// so neither redirects nor DNS records can lead requests into internal networks
+func guardedDialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		policy := destinationPolicyFromContext(ctx)
+		d := *dialer
+		d.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return errors.Wrapf(ErrDestinationRejected, "invalid address %s", address)
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !policy.allowsIP(ip) {
+				return errors.Wrapf(ErrDestinationRejected, "address %s is not allowed", host)
+			}
+			return nil
+		}
+		return d.DialContext(ctx, network, address)
+	}
+}
+
+// checkRedirect allows redirects only to hosts of bank, addresses are checked again while dialing
+func (p *destinationPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return errors.Wrap(p.checkUrl(req.URL.String()), "redirect")
+}
+
+// isRedirect reports whether res is a redirect client did not follow
+func isRedirect(res *http.Response) bool {
+	return res.StatusCode >= 300 && res.StatusCode < 400 && res.Header.Get("Location") != ""
+}
@@ -0,0 +1,17 @@
+package pkg
+
+type InspectSessionRequest struct {
+	// application trying to use bpc hack, for information purpose only
+	Application string `json:"application"`
+	// to identify each user's request one from another
+	Identity string `json:"identity"`
+	Token    string `json:"token"`
+}
+
+type InspectSessionResponse struct {
+	Status       HackResponseStatus `json:"status"`
+	MDOrder      string             `json:"md-order,omitempty"`
+	Step         SessionStep        `json:"step,omitempty"`
+	ExpirationTs int64              `json:"expiration-ts,omitempty"`
+	Cookies      []SessionCookie    `json:"cookies,omitempty"`
+}
@@ -0,0 +1,71 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics records measurements of payment flow, implementations must be safe for concurrent use
+type Metrics interface {
+	// StepStarted is called when step starts processing request
+	StepStarted(step Step)
+	// StepFinished is called for every started step with status returned to client
+	StepFinished(step Step, bank string, status HackResponseStatus)
+	// UpstreamRequest observes duration of sub-request to bank host, err is nil for successful one
+	UpstreamRequest(part string, host string, duration time.Duration, err error)
+	// UpstreamRetry counts repeated sub-request to bank host
+	UpstreamRetry(part string, host string)
+	// PaymentOpened is called when session of payment is started
+	PaymentOpened(bank string)
+	// PaymentClosed is called once for every opened payment, when it completes or its session expires
+	PaymentClosed(bank string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) StepStarted(Step)                                     {}
+func (noopMetrics) StepFinished(Step, string, HackResponseStatus)        {}
+func (noopMetrics) UpstreamRequest(string, string, time.Duration, error) {}
+func (noopMetrics) UpstreamRetry(string, string)                         {}
+func (noopMetrics) PaymentOpened(string)                                 {}
+func (noopMetrics) PaymentClosed(string)                                 {}
+
+// openPayments tracks sessions of payments neither completed nor expired, stores purge sessions silently,
+// so each session has timer closing it at expiry
+type openPayments struct {
+	mu       sync.Mutex
+	metrics  Metrics
+	payments map[string]openPayment
+}
+
+type openPayment struct {
+	bank  string
+	timer *time.Timer
+}
+
+func newOpenPayments(metrics Metrics) *openPayments {
+	return &openPayments{metrics: metrics, payments: make(map[string]openPayment)}
+}
+
+func (p *openPayments) opened(token, bank string, expiresAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.payments[token] = openPayment{
+		bank:  bank,
+		timer: time.AfterFunc(time.Until(expiresAt), func() { p.closed(token) }),
+	}
+	p.metrics.PaymentOpened(bank)
+}
+
+// closed closes payment of session, payments closed already are ignored
+func (p *openPayments) closed(token string) {
+	p.mu.Lock()
+	payment, ok := p.payments[token]
+	delete(p.payments, token)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	payment.timer.Stop()
+	p.metrics.PaymentClosed(payment.bank)
+}
@@ -0,0 +1,101 @@
+// Package metrics implements pkg.Metrics with Prometheus collectors
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"ykjam/bpchack/pkg"
+)
+
+const namespace = "bpchack"
+
+type prometheusMetrics struct {
+	stepsInFlight   *prometheus.GaugeVec
+	steps           *prometheus.CounterVec
+	upstreamLatency *prometheus.HistogramVec
+	upstreamRetries *prometheus.CounterVec
+	openPayments    *prometheus.GaugeVec
+}
+
+// NewPrometheus creates metrics registered with registerer
+func NewPrometheus(registerer prometheus.Registerer) pkg.Metrics {
+	m := &prometheusMetrics{
+		stepsInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "steps_in_flight",
+			Help:      "Payment steps being processed.",
+		}, []string{"step"}),
+		steps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "steps_total",
+			Help:      "Processed payment steps by bank and response status.",
+		}, []string{"step", "bank", "status"}),
+		upstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Duration of requests to bank hosts by part of payment step.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"part", "host", "result"}),
+		upstreamRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_retries_total",
+			Help:      "Repeated requests to bank hosts by part of payment step.",
+		}, []string{"part", "host"}),
+		openPayments: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "open_payments",
+			Help:      "Payment sessions started and neither completed nor expired.",
+		}, []string{"bank"}),
+	}
+	registerer.MustRegister(m.stepsInFlight, m.steps, m.upstreamLatency, m.upstreamRetries, m.openPayments)
+	return m
+}
+
+func (m *prometheusMetrics) StepStarted(step pkg.Step) {
+	m.stepsInFlight.WithLabelValues(string(step)).Inc()
+}
+
+func (m *prometheusMetrics) StepFinished(step pkg.Step, bank string, status pkg.HackResponseStatus) {
+	m.stepsInFlight.WithLabelValues(string(step)).Dec()
+	m.steps.WithLabelValues(string(step), bank, string(status)).Inc()
+}
+
+func (m *prometheusMetrics) UpstreamRequest(part string, host string, duration time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.upstreamLatency.WithLabelValues(part, host, result).Observe(duration.Seconds())
+}
+
+func (m *prometheusMetrics) UpstreamRetry(part string, host string) {
+	m.upstreamRetries.WithLabelValues(part, host).Inc()
+}
+
+func (m *prometheusMetrics) PaymentOpened(bank string) {
+	m.openPayments.WithLabelValues(bank).Inc()
+}
+
+func (m *prometheusMetrics) PaymentClosed(bank string) {
+	m.openPayments.WithLabelValues(bank).Dec()
+}
+
+// NewRegistry creates registry with go runtime and process collectors
+func NewRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+// Handler serves metrics of registry in Prometheus exposition format
+func Handler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
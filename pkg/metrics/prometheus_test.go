@@ -0,0 +1,131 @@
+package metrics_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ykjam/bpchack/pkg"
+	"ykjam/bpchack/pkg/bpc/mock"
+	"ykjam/bpchack/pkg/metrics"
+)
+
+// newMeasuredService creates service recording metrics to registry, with mock bank playing scenario
+func newMeasuredService(t *testing.T, scenario mock.Scenario) (*httptest.Server, pkg.Service, *prometheus.Registry) {
+	t.Helper()
+	bank := httptest.NewServer(mock.NewServer(scenario))
+	t.Cleanup(bank.Close)
+	registry := metrics.NewRegistry()
+	service := pkg.NewService([]pkg.BankProfile{{
+		Name:            "mock",
+		BaseMpiUrl:      bank.URL + mock.MPIPath,
+		AllowedNetworks: []string{"127.0.0.0/8"},
+	}}, pkg.WithTimeout(5*time.Second), pkg.WithMetrics(metrics.NewPrometheus(registry)))
+	return bank, service, registry
+}
+
+func scrape(registry *prometheus.Registry) string {
+	w := httptest.NewRecorder()
+	metrics.Handler(registry).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestPrometheusRecordsWorkflow(t *testing.T) {
+	scenario, _ := mock.ScenarioByName(mock.ScenarioSessionExpired)
+	bank, service, registry := newMeasuredService(t, scenario)
+
+	_, _ = service.Step1StartHack(context.Background(), pkg.StartHackRequest{
+		Application: "testapp",
+		Identity:    "user42",
+		PaymentUrl:  bank.URL + "/payment/merchants/mock/payment_ru.html?mdOrder=1",
+	})
+
+	body := scrape(registry)
+	host := strings.TrimPrefix(bank.URL, "http://")
+	for _, want := range []string{
+		`bpchack_steps_total{bank="mock",status="already-processed",step="start-hack"} 1`,
+		`bpchack_steps_in_flight{step="start-hack"} 0`,
+		`bpchack_upstream_request_duration_seconds_count{host="` + host + `",part="session-status",result="ok"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
+
+func TestPrometheusCountsOpenPayments(t *testing.T) {
+	scenario, _ := mock.ScenarioByName(mock.ScenarioSuccess)
+	bank, service, registry := newMeasuredService(t, scenario)
+	ctx := context.Background()
+	start := func(mdOrder string) pkg.StartHackResponse {
+		resp, err := service.Step1StartHack(ctx, pkg.StartHackRequest{
+			Application: "testapp",
+			Identity:    "user42",
+			PaymentUrl:  bank.URL + "/payment/merchants/mock/payment_ru.html?mdOrder=" + mdOrder,
+		})
+		if err != nil {
+			t.Fatalf("step1 start hack failed: %v", err)
+		}
+		return resp
+	}
+	openPayments := func() string {
+		for _, line := range strings.Split(scrape(registry), "\n") {
+			if strings.HasPrefix(line, `bpchack_open_payments{bank="mock"} `) {
+				return strings.TrimPrefix(line, `bpchack_open_payments{bank="mock"} `)
+			}
+		}
+		return ""
+	}
+
+	paid := start("0a1b2c3d-0000-4000-8000-000000000001")
+	start("0a1b2c3d-0000-4000-8000-000000000002")
+	if got := openPayments(); got != "2" {
+		t.Fatalf("open payments = %q, want 2", got)
+	}
+	_, _ = service.Step2SubmitCard(ctx, pkg.SubmitCardRequest{
+		Application: "testapp",
+		Identity:    "user42",
+		Token:       paid.Token,
+		CardNumber:  "4111111111111111",
+		Expiry:      "203012",
+		NameOnCard:  "TEST CARDHOLDER",
+	})
+	resp, err := service.Step4ConfirmPayment(ctx, pkg.ConfirmPaymentRequest{
+		Application:     "testapp",
+		Identity:        "user42",
+		Token:           paid.Token,
+		OneTimePassword: mock.DefaultOTP,
+	})
+	if err != nil || resp.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("step4 = %v, %v", resp, err)
+	}
+	if got := openPayments(); got != "1" {
+		t.Errorf("open payments after completion = %q, want 1", got)
+	}
+}
+
+func TestPrometheusClosesExpiredPayments(t *testing.T) {
+	scenario, _ := mock.ScenarioByName(mock.ScenarioSuccess)
+	scenario.RemainingSecs = 1
+	bank, service, registry := newMeasuredService(t, scenario)
+	_, err := service.Step1StartHack(context.Background(), pkg.StartHackRequest{
+		Application: "testapp",
+		Identity:    "user42",
+		PaymentUrl:  bank.URL + "/payment/merchants/mock/payment_ru.html?mdOrder=0a1b2c3d-0000-4000-8000-000000000001",
+	})
+	if err != nil {
+		t.Fatalf("step1 start hack failed: %v", err)
+	}
+	want := `bpchack_open_payments{bank="mock"} 0`
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if strings.Contains(scrape(registry), want) {
+			return
+		}
+	}
+	t.Errorf("metrics do not contain %s after session expired", want)
+}
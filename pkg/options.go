@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"ykjam/bpchack/pkg/bpc/classify"
+)
+
+const DefaultTimeout = 60 * time.Second
+
+// TransportConfig configures http.Transport shared by all requests to banks
+type TransportConfig struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// zero means no limit
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// negative value disables keep-alive probes
+	KeepAlive    time.Duration
+	DisableHTTP2 bool
+}
+
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		DialTimeout:         10 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		KeepAlive:           30 * time.Second,
+	}
+}
+
+// StepTimeouts limit duration of each workflow step including all of its sub-requests,
+// zero means step is limited only by overall client timeout
+type StepTimeouts struct {
+	StartHack      time.Duration
+	SubmitCard     time.Duration
+	ResendCode     time.Duration
+	ConfirmPayment time.Duration
+	OrderStatus    time.Duration
+}
+
+type Option func(s *service)
+
+// WithTimeout sets timeout of every single http request to bank, DefaultTimeout by default
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *service) {
+		s.timeout = timeout
+	}
+}
+
+// WithSessionStore sets store of payment sessions, sessions are kept in memory by default
+func WithSessionStore(sessions SessionStore) Option {
+	return func(s *service) {
+		s.sessions = sessions
+	}
+}
+
+func WithTransportConfig(config TransportConfig) Option {
+	return func(s *service) {
+		s.transportConfig = config
+	}
+}
+
+func WithStepTimeouts(timeouts StepTimeouts) Option {
+	return func(s *service) {
+		s.stepTimeouts = timeouts
+	}
+}
+
+// WithRetryPolicies sets retries of idempotent requests to bank, DefaultRetryPolicies by default
+func WithRetryPolicies(policies RetryPolicies) Option {
+	return func(s *service) {
+		s.retryPolicies = policies
+	}
+}
+
+// WithBreakerConfig sets circuit breaker of bank MPI hosts, DefaultBreakerConfig by default
+func WithBreakerConfig(config BreakerConfig) Option {
+	return func(s *service) {
+		s.breakerConfig = config
+	}
+}
+
+// WithMetrics sets metrics recorded by service, nothing is recorded by default
+func WithMetrics(metrics Metrics) Option {
+	return func(s *service) {
+		s.metrics = metrics
+	}
+}
+
+// WithTracerProvider sets provider of tracer recording spans of steps and their requests to banks,
+// nothing is recorded by default
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(s *service) {
+		s.tracerProvider = provider
+	}
+}
+
+// WithValidationRules overrides DefaultValidationRules of the same fields, banks may override them further
+func WithValidationRules(rules ValidationRules) Option {
+	return func(s *service) {
+		s.validationRules = rules
+	}
+}
+
+// WithErrorCatalogue sets catalogue classifying errors of bank, classify.Default by default
+func WithErrorCatalogue(catalogue *classify.Catalogue) Option {
+	return func(s *service) {
+		s.catalogue = catalogue
+	}
+}
+
+func newTransport(c TransportConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: c.KeepAlive,
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           guardedDialContext(dialer),
+		ForceAttemptHTTP2:     !c.DisableHTTP2,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if c.DisableHTTP2 {
+		// non-nil empty map disables automatic HTTP/2
+		t.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
+
+// stepContext limits ctx with step timeout, if any
+func stepContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
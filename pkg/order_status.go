@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"fmt"
+
+	"ykjam/bpchack/pkg/bpc/response"
+)
+
+type OrderStatusRequest struct {
+	// application trying to use bpc hack, for information purpose only
+	Application string `json:"application"`
+	// to identify each user's request one from another
+	Identity string `json:"identity"`
+	// session token received in start hack, when given MDOrder is taken from session
+	Token   string `json:"token,omitempty"`
+	MDOrder string `json:"md-order"`
+}
+
+// fields returns values of request by json name, for validation
+func (r OrderStatusRequest) fields() map[string]string {
+	return map[string]string{
+		"application": r.Application,
+		"identity":    r.Identity,
+		"token":       r.Token,
+		"md-order":    r.MDOrder,
+	}
+}
+
+// OrderOutcome is what bank did with money of order, as told by its order status
+type OrderOutcome string
+
+const (
+	// cardholder did not complete payment yet, or 3-D Secure authentication is in progress
+	OrderOutcomePending OrderOutcome = "pending"
+	// amount is held on card, but not deposited yet
+	OrderOutcomeApproved  OrderOutcome = "approved"
+	OrderOutcomeDeposited OrderOutcome = "deposited"
+	// authorization was declined, action code tells why
+	OrderOutcomeDeclined OrderOutcome = "declined"
+	// held amount was released
+	OrderOutcomeReversed OrderOutcome = "reversed"
+	OrderOutcomeRefunded OrderOutcome = "refunded"
+)
+
+// orderOutcomeOf normalizes orderStatus of bank, ok is false for status bpchack does not know
+func orderOutcomeOf(status response.OrderStatusCode) (outcome OrderOutcome, ok bool) {
+	switch status {
+	case response.OrderStatusRegistered, response.OrderStatusACSAuthInitiated:
+		return OrderOutcomePending, true
+	case response.OrderStatusApproved:
+		return OrderOutcomeApproved, true
+	case response.OrderStatusDeposited:
+		return OrderOutcomeDeposited, true
+	case response.OrderStatusReversed:
+		return OrderOutcomeReversed, true
+	case response.OrderStatusRefunded:
+		return OrderOutcomeRefunded, true
+	case response.OrderStatusDeclined:
+		return OrderOutcomeDeclined, true
+	}
+	return "", false
+}
+
+type OrderStatusResponse struct {
+	Status      HackResponseStatus `json:"status"`
+	MDOrder     string             `json:"md-order,omitempty"`
+	OrderNumber string             `json:"order-number,omitempty"`
+	Outcome     OrderOutcome       `json:"outcome,omitempty"`
+	// action code of processing, zero if authorization was approved
+	ActionCode            int    `json:"action-code,omitempty"`
+	ActionCodeDescription string `json:"action-code-description,omitempty"`
+	// amounts are in minor units of currency
+	Amount          int64 `json:"amount,omitempty"`
+	DepositedAmount int64 `json:"deposited-amount,omitempty"`
+	RefundedAmount  int64 `json:"refunded-amount,omitempty"`
+	// ISO 4217 numeric code, e.g. "934"
+	Currency string `json:"currency,omitempty"`
+}
+
+func (s *OrderStatusResponse) String() string {
+	return fmt.Sprintf("OrderStatusResponse {status: %v, mdOrder: %s, outcome: %s, actionCode: %d}",
+		s.Status, s.MDOrder, s.Outcome, s.ActionCode)
+}
@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// PaymentResult tells where bank sent cardholder after payment
+type PaymentResult string
+
+const (
+	// final url is return url of merchant
+	PaymentResultSuccess PaymentResult = "success"
+	// final url is fail url of merchant, or it carries error of bank
+	PaymentResultFailure PaymentResult = "failure"
+	// final url matches neither, order status tells what happened
+	PaymentResultUnknown PaymentResult = "unknown"
+)
+
+// query parameters of final url carrying error message of bank, the first one given is used
+var errorMessageParams = []string{"errorMessage", "error", "message"}
+
+// PaymentOutcome is final url of payment parsed, so clients do not have to guess by merchant pages
+type PaymentOutcome struct {
+	Result PaymentResult `json:"result"`
+	// orderId parameter BPC adds to return and fail urls, it is md-order of payment
+	OrderId      string `json:"order-id,omitempty"`
+	ErrorCode    string `json:"error-code,omitempty"`
+	ErrorMessage string `json:"error-message,omitempty"`
+}
+
+// urlPattern matches url without query and fragment, "*" matches any characters
+type urlPattern struct {
+	r *regexp.Regexp
+}
+
+func newUrlPattern(pattern string) urlPattern {
+	quoted := regexp.QuoteMeta(pattern)
+	return urlPattern{r: regexp.MustCompile(`(?i)^` + strings.ReplaceAll(quoted, `\*`, `.*`) + `$`)}
+}
+
+func newUrlPatterns(patterns []string) []urlPattern {
+	compiled := make([]urlPattern, 0, len(patterns))
+	for _, p := range patterns {
+		compiled = append(compiled, newUrlPattern(p))
+	}
+	return compiled
+}
+
+// withoutQuery returns url as patterns see it, empty if url can not be parsed
+func withoutQuery(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// exactUrlPattern matches url given to register.do, whatever its query is
+func exactUrlPattern(rawUrl string) []urlPattern {
+	stripped := withoutQuery(rawUrl)
+	if stripped == "" {
+		return nil
+	}
+	return []urlPattern{{r: regexp.MustCompile(`(?i)^` + regexp.QuoteMeta(stripped) + `$`)}}
+}
+
+func matchesAny(patterns []urlPattern, u string) bool {
+	for _, p := range patterns {
+		if p.r.MatchString(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// paymentOutcome classifies final url, urls given to register.do and kept in session come before bank patterns.
+// BPC sends cardholder to return url when fail url was not registered, so error parameters decide then.
+// Fail url wins over return url matching the same url, e.g. fail "https://shop/fail*" within return "https://shop/*"
+func (b *BankProfile) paymentOutcome(finalUrl string, session Session) PaymentOutcome {
+	outcome := PaymentOutcome{Result: PaymentResultUnknown}
+	u, err := url.Parse(finalUrl)
+	if err != nil {
+		return outcome
+	}
+	query := u.Query()
+	outcome.OrderId = query.Get("orderId")
+	outcome.ErrorCode = query.Get("errorCode")
+	outcome.ErrorMessage = firstParam(query, errorMessageParams)
+	stripped := withoutQuery(finalUrl)
+	returnPatterns, failPatterns := b.returnPatterns, b.failPatterns
+	if session.ReturnUrl != "" {
+		returnPatterns = exactUrlPattern(session.ReturnUrl)
+	}
+	if session.FailUrl != "" {
+		failPatterns = exactUrlPattern(session.FailUrl)
+	}
+	isReturn := matchesAny(returnPatterns, stripped)
+	isFail := matchesAny(failPatterns, stripped)
+	switch {
+	case (outcome.ErrorCode != "" && outcome.ErrorCode != "0") || outcome.ErrorMessage != "":
+		outcome.Result = PaymentResultFailure
+	case isFail:
+		outcome.Result = PaymentResultFailure
+	case isReturn:
+		outcome.Result = PaymentResultSuccess
+	}
+	return outcome
+}
+
+func firstParam(query url.Values, names []string) string {
+	for _, name := range names {
+		if v := query.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
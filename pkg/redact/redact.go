@@ -0,0 +1,147 @@
+// Package redact keeps card data, one-time passwords and 3-D Secure payloads out of logs.
+package redact
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/apex/log"
+
+	"ykjam/bpchack/pkg/card"
+)
+
+// MaxRawLength limits length of raw bank responses written to logs
+const MaxRawLength = 512
+
+const redacted = "[REDACTED]"
+
+type fieldKind int
+
+const (
+	fieldPlain fieldKind = iota
+	fieldSecret
+	fieldPAN
+	fieldRaw
+)
+
+// field names are compared lowercased without "-", "_" and spaces
+var fieldKinds = map[string]fieldKind{
+	"cvc":             fieldSecret,
+	"cvv":             fieldSecret,
+	"cardcvc":         fieldSecret,
+	"cvccode":         fieldSecret,
+	"otp":             fieldSecret,
+	"otpcode":         fieldSecret,
+	"onetimepassword": fieldSecret,
+	"password":        fieldSecret,
+	"pwd":             fieldSecret,
+	"pwdinputvisible": fieldSecret,
+	"pareq":           fieldSecret,
+	"pares":           fieldSecret,
+	"paresp":          fieldSecret,
+	"paresponse":      fieldSecret,
+	"pan":             fieldPAN,
+	"card":            fieldPAN,
+	"cardnumber":      fieldPAN,
+	"raw":             fieldRaw,
+	"rawresponse":     fieldRaw,
+}
+
+func kindOf(name string) fieldKind {
+	name = strings.NewReplacer("-", "", "_", "", " ", "").Replace(strings.ToLower(name))
+	return fieldKinds[name]
+}
+
+var (
+	rDigits = regexp.MustCompile(`\d{13,19}`)
+	// values of secret html inputs, e.g. <input name="PaRes" value="...">
+	rSecretInput = regexp.MustCompile(`(?i)(name\s*=\s*["']?(?:pares|pareq|password|pwdinputvisible|pwd|otp|cvc)["']?[^>]*?value\s*=\s*["']?)[^"'\s>]*`)
+	// values of secret url-encoded form parameters
+	rSecretParam = regexp.MustCompile(`(?i)\b((?:pares|pareq|password|pwdinputvisible|pwd|otp|cvc)=)[^&\s"']*`)
+)
+
+// PAN masks card number leaving first 6 and last 4 digits
+func PAN(pan string) string {
+	if len(pan) <= 10 {
+		return strings.Repeat("*", len(pan))
+	}
+	return pan[:6] + strings.Repeat("*", len(pan)-10) + pan[len(pan)-4:]
+}
+
+// Text masks card numbers and values of secret form fields found in free text
+func Text(s string) string {
+	s = rDigits.ReplaceAllStringFunc(s, func(digits string) string {
+		if !card.Luhn(digits) {
+			return digits
+		}
+		return PAN(digits)
+	})
+	s = rSecretInput.ReplaceAllString(s, "${1}"+redacted)
+	return rSecretParam.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// Raw sanitizes and truncates raw bank response
+func Raw(s string) string {
+	s = Text(s)
+	if len(s) > MaxRawLength {
+		return s[:MaxRawLength] + "...(truncated)"
+	}
+	return s
+}
+
+// Fields returns copy of fields safe to be logged, secret fields are dropped
+func Fields(fields log.Fields) log.Fields {
+	clean := make(log.Fields, len(fields))
+	for name, value := range fields {
+		kind := kindOf(name)
+		if kind == fieldSecret {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			switch kind {
+			case fieldPAN:
+				clean[name] = PAN(v)
+			case fieldRaw:
+				clean[name] = Raw(v)
+			default:
+				clean[name] = Text(v)
+			}
+		case error:
+			if msg := v.Error(); Text(msg) != msg {
+				clean[name] = errors.New(Text(msg))
+			} else {
+				clean[name] = v
+			}
+		default:
+			clean[name] = v
+		}
+	}
+	return clean
+}
+
+// Handler sanitizes entries before passing them to wrapped handler
+type Handler struct {
+	next log.Handler
+}
+
+func NewHandler(next log.Handler) *Handler {
+	return &Handler{next: next}
+}
+
+func (h *Handler) HandleLog(e *log.Entry) error {
+	clean := *e
+	clean.Fields = Fields(e.Fields)
+	clean.Message = Text(e.Message)
+	return h.next.HandleLog(&clean)
+}
+
+// Install wraps handler of the default logger, should be called after log handler is configured
+func Install() {
+	if l, ok := log.Log.(*log.Logger); ok {
+		if _, done := l.Handler.(*Handler); !done {
+			l.Handler = NewHandler(l.Handler)
+		}
+	}
+}
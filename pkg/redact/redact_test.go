@@ -0,0 +1,81 @@
+package redact_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+
+	"ykjam/bpchack/pkg/redact"
+)
+
+func TestPAN(t *testing.T) {
+	tests := map[string]string{
+		"4111111111111111":    "411111******1111",
+		"5555555555554444":    "555555******4444",
+		"9934123456789012345": "993412*********2345",
+		"1234":                "****",
+	}
+	for pan, want := range tests {
+		if got := redact.PAN(pan); got != want {
+			t.Errorf("PAN(%s) = %s, want %s", pan, got, want)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"card 4111111111111111 rejected", "card 411111******1111 rejected"},
+		{"order 1234567890123 not luhn", "order 1234567890123 not luhn"},
+		{`<input type="hidden" name="PaRes" value="eJzVWFmTqkgW/">`, `<input type="hidden" name="PaRes" value="[REDACTED]">`},
+		{"MD=1&PaRes=eJzVWFmT&TermUrl=x", "MD=1&PaRes=[REDACTED]&TermUrl=x"},
+		{"password=123456&submit=1", "password=[REDACTED]&submit=1"},
+		{"request_id=r1&pwdInputVisible=123456&submit=1", "request_id=r1&pwdInputVisible=[REDACTED]&submit=1"},
+		{`<input id="pwdInputVisible" type="password" name="pwdInputVisible" value="123456" />`,
+			`<input id="pwdInputVisible" type="password" name="pwdInputVisible" value="[REDACTED]" />`},
+	}
+	for _, tt := range tests {
+		if got := redact.Text(tt.in); got != tt.want {
+			t.Errorf("Text(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	mem := memory.New()
+	logger := &log.Logger{Handler: redact.NewHandler(mem), Level: log.DebugLevel}
+	logger.WithFields(log.Fields{
+		"card-number":     "4111111111111111",
+		"cvc":             "123",
+		"otp-code":        "123456",
+		"pa-resp":         "eJzVWFmT",
+		"pwdInputVisible": "123456",
+		"raw":             strings.Repeat("<p>", 1000),
+		"md-order":        "0a1b2c3d",
+	}).Info("card 4111111111111111 submitted")
+
+	if len(mem.Entries) != 1 {
+		t.Fatalf("entries = %d, want 1", len(mem.Entries))
+	}
+	e := mem.Entries[0]
+	if e.Message != "card 411111******1111 submitted" {
+		t.Errorf("message = %s", e.Message)
+	}
+	for _, name := range []string{"cvc", "otp-code", "pa-resp", "pwdInputVisible"} {
+		if _, ok := e.Fields[name]; ok {
+			t.Errorf("field %s must be dropped", name)
+		}
+	}
+	if got := e.Fields.Get("card-number"); got != "411111******1111" {
+		t.Errorf("card-number = %v", got)
+	}
+	if raw, _ := e.Fields.Get("raw").(string); len(raw) > redact.MaxRawLength+len("...(truncated)") {
+		t.Errorf("raw is not truncated, length %d", len(raw))
+	}
+	if got := e.Fields.Get("md-order"); got != "0a1b2c3d" {
+		t.Errorf("md-order = %v", got)
+	}
+}
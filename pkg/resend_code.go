@@ -4,13 +4,26 @@ import "fmt"
 
 type ResendCodeRequest struct {
 	// application trying to use bpc hack, for information purpose only
-	Application string `json:"app"`
+	Application string `json:"application"`
 	// to identify each user's request one from another
-	Identity      string `json:"id"`
+	Identity string `json:"identity"`
+	// session token received in start hack, when given ACS parameters are taken from session
+	Token         string `json:"token,omitempty"`
 	ACSRequestId  string `json:"acs-request-id"`
 	ACSSessionUrl string `json:"acs-session-url"`
 }
 
+// fields returns values of request by json name, for validation
+func (r ResendCodeRequest) fields() map[string]string {
+	return map[string]string{
+		"application":     r.Application,
+		"identity":        r.Identity,
+		"token":           r.Token,
+		"acs-request-id":  r.ACSRequestId,
+		"acs-session-url": r.ACSSessionUrl,
+	}
+}
+
 type ResendCodeResponse struct {
 	Status             HackResponseStatus `json:"status"`
 	ResendAttemptsLeft int                `json:"resend-attempts-left"`
@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryPolicy controls how failed request to bank is repeated,
+// delay before n-th retry is random between zero and BaseDelay*2^(n-1) limited by MaxDelay
+type RetryPolicy struct {
+	// retries after the first attempt, zero disables retries
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// RetryPolicies configure retries of sub-requests which are safe to repeat,
+// card submission, sending and submitting of one-time password are never retried
+type RetryPolicies struct {
+	// getSessionStatus.do of Step1StartHack
+	SessionStatus RetryPolicy
+	// opening of ACS authentication page in Step2SubmitCard, repeated only when connection to ACS
+	// was not established, since authentication request may send one-time password
+	ACSPage RetryPolicy
+	// getOrderStatusExtended.do of Step5OrderStatus
+	OrderStatus RetryPolicy
+}
+
+func DefaultRetryPolicies() RetryPolicies {
+	return RetryPolicies{
+		SessionStatus: RetryPolicy{MaxRetries: 2, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second},
+		ACSPage:       RetryPolicy{MaxRetries: 1, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second},
+		OrderStatus:   RetryPolicy{MaxRetries: 2, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second},
+	}
+}
+
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// delay returns jittered exponential backoff before retry, retry starts from 1
+func (p RetryPolicy) delay(retry int) time.Duration {
+	ceiling := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || ceiling < p.MaxDelay); i++ {
+		ceiling *= 2
+	}
+	if p.MaxDelay > 0 && ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitter.Int63n(int64(ceiling) + 1))
+}
+
+// isRetryable reports whether request failed for reason which may go away on its own,
+// i.e. network failure or gateway error, and not because of caller or policy
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrDestinationRejected) {
+		return false
+	}
+	var network *NetworkError
+	if errors.As(err, &network) {
+		return true
+	}
+	var unexpected *UnexpectedStatusError
+	if errors.As(err, &unexpected) {
+		switch unexpected.Code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+// isDialError reports whether request failed before connection to bank was established,
+// so request which is not safe to repeat did not reach bank either
+func isDialError(err error) bool {
+	var op *net.OpError
+	return isRetryable(err) && errors.As(err, &op) && op.Op == "dial"
+}
+
+// retryForm posts form like postForm and repeats attempts failed with errors retryable accepts
+// according to policy while deadline of ctx allows
+func (s *service) retryForm(ctx context.Context, clog *log.Entry, client *http.Client, policy RetryPolicy, retryable func(error) bool, part, rawUrl string, form url.Values) (res *http.Response, data []byte, err error) {
+	for retry := 0; ; retry++ {
+		res, data, err = s.postForm(ctx, clog, client, part, rawUrl, form)
+		if err == nil {
+			if retry > 0 {
+				clog.WithField("retries", retry).Info("request succeeded after retries")
+			}
+			return
+		}
+		if retry >= policy.MaxRetries || !retryable(err) {
+			if retry > 0 {
+				clog.WithError(err).WithField("retries", retry).Error("request failed after retries")
+			}
+			return
+		}
+		delay := policy.delay(retry + 1)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			clog.WithField("retries", retry).Warn("no time left for retry")
+			return
+		}
+		clog.WithError(err).WithFields(log.Fields{
+			"retry": retry + 1,
+			"delay": delay,
+		}).Warn("retrying request")
+		s.metrics.UpstreamRetry(part, hostOf(rawUrl))
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.String("bpchack.part", part),
+			attribute.Int("bpchack.retry", retry+1),
+		))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
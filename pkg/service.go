@@ -3,17 +3,18 @@ package pkg
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 
+	"ykjam/bpchack/pkg/bpc/acs"
+	"ykjam/bpchack/pkg/bpc/classify"
 	"ykjam/bpchack/pkg/bpc/response"
 )
 
@@ -22,73 +23,116 @@ type Service interface {
 	Step2SubmitCard(ctx context.Context, req SubmitCardRequest) (SubmitCardResponse, error)
 	Step3ResendCode(ctx context.Context, req ResendCodeRequest) (ResendCodeResponse, error)
 	Step4ConfirmPayment(ctx context.Context, req ConfirmPaymentRequest) (ConfirmPaymentResponse, error)
+	// Step5OrderStatus asks bank what happened to order, confirmed payment is not necessarily deposited
+	Step5OrderStatus(ctx context.Context, req OrderStatusRequest) (OrderStatusResponse, error)
+	// InspectSession returns session state including bank cookies, for debugging purposes only
+	InspectSession(ctx context.Context, req InspectSessionRequest) (InspectSessionResponse, error)
+	// InspectBreakers returns state of circuit breakers of bank MPI hosts
+	InspectBreakers(ctx context.Context) (InspectBreakersResponse, error)
 }
 
 type service struct {
-	timeout    time.Duration
-	baseMpiUrl string
+	timeout         time.Duration
+	banks           []BankProfile
+	sessions        SessionStore
+	transportConfig TransportConfig
+	stepTimeouts    StepTimeouts
+	retryPolicies   RetryPolicies
+	breakerConfig   BreakerConfig
+	breakers        map[string]*breaker
+	validationRules ValidationRules
+	catalogue       *classify.Catalogue
+	metrics         Metrics
+	openPayments    *openPayments
+	tracerProvider  trace.TracerProvider
+	tracer          trace.Tracer
 }
 
-// Constants to get 3D Secure Phone number are ThreeDSecurePhoneTipBegin and ThreeDSecurePhoneTipEnd
-// format of HTML used is
-//
-// <div id="tipContainer" class="tipContainer"><span class="tip">One-time password will be sent to number {3DSECURE}</span></div>
-//
-// Constants to get 3D Secure Passwords attempts are ThreeDSecurePasswordAttemptsBegin and
-// ThreeDSecurePasswordAttemptsEnd
-// form of HTML used is
-//
-// <a id="resendPasswordLink" href="#" title="{3DSECURE} password send attempt(s) left" onclick="jsf.util.chain
-//
-// To get wrong password attempts in form of HTML
-//
-// <div id="errorContainer" class="errorContainer"><ul><li class="errorMessage">	Wrong password typed attempt {1} of {3} </li></ul></div>
-//
-//
-// to get some parameters PaRes in form of HTML is below
-//
-// <input type="hidden" name="PaRes" value="{CODE}" />
-
-const ThreeDSecurePhoneTipBegin = `<div id="tipContainer" class="tipContainer"><span class="tip">One-time password will be sent to number `
-const ThreeDSecurePhoneTipEnd = `</span></div>`
-
-const ThreeDSecurePasswordAttemptsBegin = `<a id="resendPasswordLink" href="#" title="`
-const ThreeDSecurePasswordAttemptsEnd = ` password send attempt(s) left" onclick="jsf.util.chain`
-
-const ThreeDSecureWrongPasswordAttemptBegin = `<div id="errorContainer" class="errorContainer"><ul><li class="errorMessage">	Wrong password typed attempt `
-const ThreeDSecureWrongPasswordAttemptMiddle = ` of `
-const ThreeDSecureWrongPasswordAttemptEnd = ` </li></ul></div>`
-const ThreeDSecureWrongPasswordFinal = `<span class="operationCancelledMessage">Operation cancelled</span>`
-
-const ThreeDSecurePaymentResponseBegin = `<input type="hidden" name="PaRes" value="`
-const ThreeDSecurePaymentResponseEnd = `" />`
-
-var ErrWrongPasswordOperationCancelled = errors.New("wrong password, operation cancelled")
-
-func (s *service) generateClient() *http.Client {
+// generateClient returns client for payment flow with bank, jar keeps cookies of the flow between sub-requests
+func (s *service) generateClient(bank *BankProfile, jar http.CookieJar) *http.Client {
+	timeout := s.timeout
+	if bank.Timeout > 0 {
+		timeout = bank.Timeout
+	}
 	return &http.Client{
-		Timeout: s.timeout,
+		Transport:     bank.transport,
+		Timeout:       timeout,
+		Jar:           jar,
+		CheckRedirect: bank.policy.checkRedirect,
 	}
 }
 
-func (s *service) getSessionUrl() string {
-	return fmt.Sprintf("%s/getSessionStatus.do", s.baseMpiUrl)
-}
-
-func (s *service) getProcessFormUrl() string {
-	return fmt.Sprintf("%s/processform.do", s.baseMpiUrl)
+// postForm posts form to url of bank and reads body of 200 response, redirect client stopped at
+// is returned without body, failures are returned as NetworkError or UnexpectedStatusError
+func (s *service) postForm(ctx context.Context, clog *log.Entry, client *http.Client, part, rawUrl string, form url.Values) (res *http.Response, data []byte, err error) {
+	spanCtx, span := s.startUpstreamSpan(ctx, part, hostOf(rawUrl))
+	start := time.Now()
+	defer func() {
+		s.metrics.UpstreamRequest(part, hostOf(rawUrl), time.Since(start), err)
+		endUpstreamSpan(span, res, err)
+	}()
+	var r *http.Request
+	r, err = http.NewRequestWithContext(spanCtx, http.MethodPost, rawUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		eMsg := "error creating http request"
+		clog.WithError(err).Error(eMsg)
+		err = errors.Wrap(err, eMsg)
+		return
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err = client.Do(r)
+	if err != nil {
+		clog.WithError(err).Error("error making http request")
+		err = &NetworkError{Url: rawUrl, Err: err}
+		return
+	}
+	defer func() {
+		errClose := res.Body.Close()
+		if errClose != nil {
+			clog.WithError(errClose).Error("error in response.Body.Close")
+		}
+	}()
+	if isRedirect(res) {
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		err = &UnexpectedStatusError{Url: rawUrl, Code: res.StatusCode}
+		clog.WithError(err).Error("invalid http status code")
+		return
+	}
+	data, err = io.ReadAll(res.Body)
+	clog.WithField("raw", string(data)).Debug("Response received")
+	if err != nil {
+		clog.WithError(err).Error("error reading http response")
+		err = &NetworkError{Url: rawUrl, Err: err}
+		return
+	}
+	return
 }
 
 func (s *service) Step1StartHack(ctx context.Context, req StartHackRequest) (resp StartHackResponse, err error) {
-	clog := log.WithFields(log.Fields{
+	clog := log.FromContext(ctx).WithFields(log.Fields{
 		"app":       req.Application,
 		"id":        req.Identity,
 		"operation": "Step 1. Start Hack",
 	})
 	clog.Info("Processing")
+	part := ""
+	var bank *BankProfile
+	ctx, span := s.startStepSpan(ctx, "Step1StartHack", req.Application, req.Identity)
+	s.metrics.StepStarted(StepStartHack)
+	defer func() {
+		if err != nil {
+			resp.Status = StatusFromError(err)
+		}
+		s.metrics.StepFinished(StepStartHack, bank.label(), resp.Status)
+		err = operationError(StepStartHack, part, err)
+		endStepSpan(span, bank, resp.Status, err)
+	}()
 	resp.Status = HackResponseStatusOtherError
 	// parse payment url
 	var paymentUrl *url.URL
+	part = PartPaymentUrl
 	paymentUrl, err = url.Parse(req.PaymentUrl)
 	if err != nil {
 		eMsg := "error parsing payment url"
@@ -96,69 +140,55 @@ func (s *service) Step1StartHack(ctx context.Context, req StartHackRequest) (res
 		err = errors.Wrap(err, eMsg)
 		return
 	}
-	mdOrder := paymentUrl.Query().Get("mdOrder")
-	resp.MDOrder = mdOrder
-	// check session status
-	client := s.generateClient()
-	form := url.Values{}
-	form.Add("MDORDER", mdOrder)
-	var res *http.Response
-	var r *http.Request
-	var data []byte
-
-	r, err = http.NewRequestWithContext(ctx, http.MethodPost, s.getSessionUrl(), strings.NewReader(form.Encode()))
+	part = PartBank
+	bank, err = s.bankByPaymentUrl(paymentUrl)
 	if err != nil {
-		eMsg := "error creating http request"
-		clog.WithError(err).Error(eMsg)
+		eMsg := "error choosing bank"
+		clog.WithError(err).WithField("host", paymentUrl.Host).Error(eMsg)
 		err = errors.Wrap(err, eMsg)
 		return
 	}
-	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err = client.Do(r)
+	clog = clog.WithField("bank", bank.Name)
+	part = PartRequest
+	err = bank.validator.check(StepStartHack, req.fields())
 	if err != nil {
-		eMsg := "error making http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		resp.Status = HackResponseStatusNetworkError
+		clog.WithError(err).Warn("request is not valid")
 		return
 	}
-	if res.StatusCode != http.StatusOK {
-		eMsg := fmt.Sprintf("invalid http status code: %d", res.StatusCode)
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		resp.Status = HackResponseStatusOtherError
+	ctx, cancel := stepContext(ctx, s.timeoutsFor(bank).StartHack)
+	defer cancel()
+	ctx = withDestinationPolicy(ctx, bank.policy)
+	mdOrder := paymentUrl.Query().Get("mdOrder")
+	clog = clog.WithField("md-order", mdOrder)
+	resp.MDOrder = mdOrder
+	// check session status
+	jar := newPaymentJar(nil)
+	client := s.generateClient(bank, jar)
+	form := url.Values{}
+	form.Add("MDORDER", mdOrder)
+
+	part = PartSessionStatus
+	if !bank.breaker.allow() {
+		err = ErrBankUnavailable
+		clog.WithError(err).Warn("request to bank is not made")
 		return
 	}
-	data, err = io.ReadAll(res.Body)
-	defer func() {
-		errClose := res.Body.Close()
-		if errClose != nil {
-			clog.WithError(errClose).Error("error in response.Body.Close")
-		}
-	}()
-
-	rawResponse := string(data)
-	clog.WithField("raw", rawResponse).Info("Response received")
+	var data []byte
+	_, data, err = s.retryForm(ctx, clog, client, s.retryPolicies.SessionStatus, isRetryable, PartSessionStatus, bank.sessionStatusUrl(), form)
+	bank.breaker.done(err)
 	if err != nil {
-		eMsg := "error reading http response"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
 		return
 	}
 	var bpcResponse response.SessionStatus
 	err = json.Unmarshal(data, &bpcResponse)
 	if err != nil {
-		eMsg := "error parsing json response"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
+		clog.WithError(err).Error("error parsing json response")
+		err = &ParseError{Page: PageSessionStatus, Err: err}
 		return
 	}
 	if !bpcResponse.IsValid() {
-		eMsg := "session expired or already processed"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		resp.Status = HackResponseStatusAlreadyProcessed
+		err = &SessionExpiredError{MDOrder: mdOrder}
+		clog.WithError(err).Error("session expired or already processed")
 		return
 	}
 	// response is valid
@@ -169,84 +199,217 @@ func (s *service) Step1StartHack(ctx context.Context, req StartHackRequest) (res
 
 	resp.IsCVCRequired = !bpcResponse.CvcNotRequired
 	resp.AmountInfo = bpcResponse.Amount
+
+	part = PartSession
+	resp.Token, err = s.startSession(ctx, req, resp, bank, jar.Export())
+	if err != nil {
+		eMsg := "error starting session"
+		clog.WithError(err).Error(eMsg)
+		err = errors.Wrap(err, eMsg)
+		resp.Token = ""
+		return
+	}
+	return
+}
+
+func (s *service) startSession(ctx context.Context, req StartHackRequest, resp StartHackResponse, bank *BankProfile, cookies []SessionCookie) (token string, err error) {
+	token, err = newSessionToken()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	expiresAt := time.Unix(resp.ExpirationTs, 0)
+	var traceId, spanId string
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		traceId, spanId = sc.TraceID().String(), sc.SpanID().String()
+	}
+	err = s.sessions.Save(ctx, Session{
+		Token:       token,
+		Application: req.Application,
+		Identity:    req.Identity,
+		Bank:        bank.Name,
+		MDOrder:     resp.MDOrder,
+		ReturnUrl:   req.ReturnUrl,
+		FailUrl:     req.FailUrl,
+		Cookies:     cookies,
+		Step:        SessionStepStarted,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		ExpiresAt:   expiresAt,
+		TraceId:     traceId,
+		SpanId:      spanId,
+	})
+	if err != nil {
+		return
+	}
+	s.openPayments.opened(token, bank.Name, expiresAt)
 	return
 }
 
+// loadSession returns session for token, session must belong to the same application and identity
+func (s *service) loadSession(ctx context.Context, token, application, identity string) (session Session, err error) {
+	session, err = s.sessions.Load(ctx, token)
+	if err != nil {
+		return
+	}
+	if session.Application != application || session.Identity != identity {
+		// do not give a hint that token exists
+		session = Session{}
+		err = ErrSessionNotFound
+	}
+	return
+}
+
+// updateSession saves session together with cookies collected in jar, sessionless flows are ignored
+func (s *service) updateSession(ctx context.Context, clog *log.Entry, session Session, jar *paymentJar) {
+	if session.Token == "" {
+		return
+	}
+	session.Cookies = jar.Export()
+	clog.WithField("cookies", len(session.Cookies)).Debug("saving session")
+	session.UpdatedAt = time.Now()
+	err := s.sessions.Save(ctx, session)
+	if err != nil {
+		clog.WithError(err).Error("error saving session")
+	}
+}
+
 func (s *service) Step2SubmitCard(ctx context.Context, req SubmitCardRequest) (resp SubmitCardResponse, err error) {
-	clog := log.WithFields(log.Fields{
+	clog := log.FromContext(ctx).WithFields(log.Fields{
 		"app":       req.Application,
 		"id":        req.Identity,
 		"operation": "Step 2. Submit Card",
 	})
 	clog.Info("Processing")
+	part := ""
+	var bank *BankProfile
+	ctx, span := s.startStepSpan(ctx, "Step2SubmitCard", req.Application, req.Identity,
+		s.paymentLinks(ctx, req.Token, req.Application, req.Identity)...)
+	s.metrics.StepStarted(StepSubmitCard)
+	defer func() {
+		if err != nil {
+			resp.Status = StatusFromError(err)
+		}
+		if req.Token != "" {
+			// raw bank urls stay in session, clients only hold token
+			resp.ACSRequestId, resp.ACSSessionUrl, resp.TerminateUrl = "", "", ""
+		}
+		s.metrics.StepFinished(StepSubmitCard, bank.label(), resp.Status)
+		err = operationError(StepSubmitCard, part, err)
+		endStepSpan(span, bank, resp.Status, err)
+	}()
 	resp.Status = HackResponseStatusOtherError
+	// as given, before fields are taken from session
+	fields := req.fields()
 
-	// submit card
-	var bpcResponsePart1 response.PaymentProcessForm
-	bpcResponsePart1, err = s.step2part1SubmitCard(ctx, clog, req)
+	var session Session
+	if req.Token != "" {
+		part = PartSession
+		session, err = s.loadSession(ctx, req.Token, req.Application, req.Identity)
+		if err != nil {
+			eMsg := "error loading session"
+			clog.WithError(err).Error(eMsg)
+			err = errors.Wrap(err, eMsg)
+			return
+		}
+		if session.Step == SessionStepCompleted {
+			err = ErrPaymentCompleted
+			clog.WithError(err).Error("payment of session is completed")
+			return
+		}
+		req.MDOrder = session.MDOrder
+	}
+	clog = clog.WithField("md-order", req.MDOrder)
+	part = PartBank
+	bank, err = s.bankByName(session.Bank)
 	if err != nil {
-		eMsg := "error in part 1"
+		eMsg := "error choosing bank"
 		clog.WithError(err).Error(eMsg)
 		err = errors.Wrap(err, eMsg)
-		resp.Status = HackResponseStatusOtherError
-		return
-	}
-	if !bpcResponsePart1.IsValid() {
-		eMsg := "invalid bpc response"
-		if bpcResponsePart1.ErrorCode == 1 {
-			clog.WithField("response-error", bpcResponsePart1.Error).Error("error in response")
-			if bpcResponsePart1.IsCardError() {
-				resp.Status = HackResponseStatusInvalidCard
-			} else if bpcResponsePart1.IsCVCError() {
-				// error here, can be one of specify cvc or wrong card or something else
-				eMsg = "specify cvc"
-				resp.Status = HackResponseStatusSpecifyCVC
-			} else {
-				resp.Status = HackResponseStatusOtherError
-			}
-		} else {
-			resp.Status = HackResponseStatusOtherError
-		}
+		return
+	}
+	clog = clog.WithField("bank", bank.Name)
+	part = PartRequest
+	err = bank.validator.check(StepSubmitCard, fields)
+	if err != nil {
+		clog.WithError(err).Warn("request is not valid")
+		return
+	}
+	err = validateCard(&req, time.Now())
+	if err != nil {
+		clog.WithError(err).Warn("card details are not valid")
+		return
+	}
+	ctx, cancel := stepContext(ctx, s.timeoutsFor(bank).SubmitCard)
+	defer cancel()
+	ctx = withDestinationPolicy(ctx, bank.policy)
+	jar := newPaymentJar(session.Cookies)
+	client := s.generateClient(bank, jar)
+
+	// submit card
+	var bpcResponsePart1 response.PaymentProcessForm
+	part = PartProcessForm
+	bpcResponsePart1, err = s.step2part1SubmitCard(ctx, clog, client, bank, req)
+	if err != nil {
+		clog.WithError(err).Error("error in part 1")
+		return
+	}
+	resp.TerminateUrl = bpcResponsePart1.TermUrl
+	part = PartDestination
+	err = bank.checkDestination(bpcResponsePart1.ACSUrl, bpcResponsePart1.TermUrl)
+	if err != nil {
+		eMsg := "bank responded with unapproved destination"
 		clog.WithError(err).Error(eMsg)
 		err = errors.Wrap(err, eMsg)
 		return
 	}
-	resp.TerminateUrl = bpcResponsePart1.TermUrl
 
 	clog.Info("Submitting ACS Form")
 	var bpcResponsePart2 response.ACSSubmitForm
-	bpcResponsePart2, err = s.step2part2SubmitACS(ctx, clog, req.MDOrder,
+	part = PartACSStart
+	bpcResponsePart2, err = s.step2part2SubmitACS(ctx, clog, client, req.MDOrder,
 		bpcResponsePart1.PaReq, bpcResponsePart1.ACSUrl, bpcResponsePart1.TermUrl)
 	if err != nil {
-		eMsg := "error in part 2"
+		clog.WithError(err).Error("error in part 2")
+		return
+	}
+	part = PartDestination
+	err = bank.checkDestination(bpcResponsePart2.ACSSessionUrl)
+	if err != nil {
+		eMsg := "acs redirected to unapproved destination"
 		clog.WithError(err).Error(eMsg)
 		err = errors.Wrap(err, eMsg)
-		resp.Status = HackResponseStatusOtherError
 		return
 	}
 	resp.ACSRequestId = bpcResponsePart2.ACSRequestId
 	resp.ACSSessionUrl = bpcResponsePart2.ACSSessionUrl
 	resp.ThreeDSecureNumber = bpcResponsePart2.ThreeDSecureNumber
 	var attemptsLeft int
-	attemptsLeft, err = s.step2part3ACSSendPassword(ctx, clog,
+	part = PartACSSendPassword
+	attemptsLeft, err = s.step2part3ACSSendPassword(ctx, clog, client,
 		bpcResponsePart2.ACSRequestId,
 		bpcResponsePart2.ACSSessionUrl)
 	if err != nil {
-		eMsg := "error in part 2"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		resp.Status = HackResponseStatusOtherError
+		clog.WithError(err).Error("error in part 3")
 		return
 	}
 	resp.ResendAttemptsLeft = attemptsLeft
 	resp.Status = HackResponseStatusOk
+	if session.Token == "" {
+		// sessionless clients pass acs parameters to following steps themselves
+		return
+	}
+	session.ACSRequestId = resp.ACSRequestId
+	session.ACSSessionUrl = resp.ACSSessionUrl
+	session.TerminateUrl = resp.TerminateUrl
+	session.Step = SessionStepCardSubmitted
+	s.updateSession(ctx, clog, session, jar)
 	return
 }
 
-func (s *service) step2part1SubmitCard(ctx context.Context, pLog *log.Entry, req SubmitCardRequest) (resp response.PaymentProcessForm, err error) {
+func (s *service) step2part1SubmitCard(ctx context.Context, pLog *log.Entry, client *http.Client, bank *BankProfile, req SubmitCardRequest) (resp response.PaymentProcessForm, err error) {
 	clog := pLog.WithField("part", "Part 1. Submit Form")
 
-	client := s.generateClient()
 	form := url.Values{}
 	form.Add("MDORDER", req.MDOrder)
 	form.Add("$PAN", req.CardNumber)
@@ -265,53 +428,36 @@ func (s *service) step2part1SubmitCard(ctx context.Context, pLog *log.Entry, req
 	} else {
 		form.Add("$CVC", "")
 	}
-	var res *http.Response
-	var r *http.Request
 	var data []byte
-
-	r, err = http.NewRequestWithContext(ctx, http.MethodPost, s.getProcessFormUrl(), strings.NewReader(form.Encode()))
+	_, data, err = s.postForm(ctx, clog, client, PartProcessForm, bank.processFormUrl(), form)
 	if err != nil {
-		eMsg := "error creating http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
 		return
 	}
-	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err = client.Do(r)
+	err = json.Unmarshal(data, &resp)
 	if err != nil {
-		eMsg := "error making http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
+		clog.WithError(err).Error("error parsing json response")
+		err = &ParseError{Page: PageProcessForm, Err: err}
 		return
 	}
-	if res.StatusCode != http.StatusOK {
-		eMsg := fmt.Sprintf("invalid http status code: %d", res.StatusCode)
-		clog.Error(eMsg)
-		err = errors.New(eMsg)
-		return
-	}
-	data, err = io.ReadAll(res.Body)
-	defer func() {
-		errClose := res.Body.Close()
-		if errClose != nil {
-			clog.WithError(errClose).Error("error in response.Body.Close")
+	if resp.ErrorCode != 0 {
+		reason, known := s.catalogue.Classify(resp.ErrorCode, resp.Error)
+		if !known {
+			// to be added to catalogue
+			clog.WithFields(log.Fields{
+				"error-code":     resp.ErrorCode,
+				"response-error": resp.Error,
+			}).Warn("bank error is not in catalogue")
 		}
-	}()
-
-	rawResponse := string(data)
-	clog.WithField("raw", rawResponse).Debug("Response received")
-	if err != nil {
-		eMsg := "error reading http response"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
+		err = &BankRejectedError{Code: resp.ErrorCode, Message: resp.Error, Reason: reason}
+		clog.WithFields(log.Fields{
+			"response-error": resp.Error,
+			"reason":         reason,
+		}).Error("error in response")
 		return
 	}
-	err = json.Unmarshal(data, &resp)
-	if err != nil {
-		eMsg := "error parsing json response"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
+	if !resp.IsValid() {
+		clog.Error("invalid bpc response")
+		err = &ParseError{Page: PageProcessForm, Err: errors.New("acs url, PaReq or terminate url is missing")}
 		return
 	}
 	clog.Info("part 1 complete")
@@ -319,91 +465,38 @@ func (s *service) step2part1SubmitCard(ctx context.Context, pLog *log.Entry, req
 	return
 }
 
-func (s *service) step2part2SubmitACS(ctx context.Context, pLog *log.Entry, mdOrder, paReq, acsUrl, termUrl string) (resp response.ACSSubmitForm, err error) {
+func (s *service) step2part2SubmitACS(ctx context.Context, pLog *log.Entry, client *http.Client, mdOrder, paReq, acsUrl, termUrl string) (resp response.ACSSubmitForm, err error) {
 	clog := pLog.WithField("part", "Part 2. Submit ACS")
 
-	client := s.generateClient()
 	form := url.Values{}
 	form.Add("MD", mdOrder)
 	form.Add("PaReq", paReq)
 	form.Add("TermUrl", termUrl)
 
 	var res *http.Response
-	var r *http.Request
 	var data []byte
-
-	r, err = http.NewRequestWithContext(ctx, http.MethodPost, acsUrl, strings.NewReader(form.Encode()))
+	// authentication request may send one-time password, it is repeated only when it did not reach ACS
+	res, data, err = s.retryForm(ctx, clog, client, s.retryPolicies.ACSPage, isDialError, PartACSStart, acsUrl, form)
 	if err != nil {
-		eMsg := "error creating http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		return
-	}
-	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err = client.Do(r)
-	if err != nil {
-		eMsg := "error making http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		return
-	}
-	if res.StatusCode != http.StatusOK {
-		eMsg := fmt.Sprintf("invalid http status code: %d", res.StatusCode)
-		clog.Error(eMsg)
-		err = errors.New(eMsg)
-		return
-	}
-	data, err = io.ReadAll(res.Body)
-	defer func() {
-		errClose := res.Body.Close()
-		if errClose != nil {
-			clog.WithError(errClose).Error("error in response.Body.Close")
-		}
-	}()
-
-	rawResponse := string(data)
-	clog.WithField("raw", rawResponse).Debug("Response received")
-	if err != nil {
-		eMsg := "error reading http response"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		return
-	}
-	if res.Request == nil {
-		eMsg := "request of response is nil"
-		clog.Error(eMsg)
-		err = errors.New(eMsg)
-		return
-	}
-	if res.Request.URL == nil {
-		eMsg := "url of request of response is nil"
-		clog.Error(eMsg)
-		err = errors.New(eMsg)
 		return
 	}
 
+	// acs redirects to its authentication page, request id is taken from its url
 	redirectURL := res.Request.URL
 	clog.WithField("acs-redirect-url", redirectURL).Info("Redirected to ACS page")
 	resp.ACSSessionUrl = redirectURL.String()
 	resp.ACSRequestId = redirectURL.Query().Get("request_id")
-	// parse html, look for
-	// <div id=\"tipContainer\" class=\"tipContainer\"><span class=\"tip\">One-time password will be sent to number ${3DSecure Number}</span></div>
-	index1 := strings.Index(rawResponse, ThreeDSecurePhoneTipBegin)
-	if index1 == -1 {
-		eMsg := "'ThreeDSecurePhoneTipBegin' was not found in response"
-		err = errors.New(eMsg)
-		return
+	var page *acs.ACSPage
+	page, err = acs.ParseString(string(data))
+	if err == nil {
+		err = page.Require(acs.FieldPhoneTip)
 	}
-	index1 += len(ThreeDSecurePhoneTipBegin)
-	firstPart := rawResponse[index1:]
-	index2 := strings.Index(firstPart, ThreeDSecurePhoneTipEnd)
-	if index1 == -1 {
-		eMsg := "'ThreeDSecurePhoneTipEnd' was not found in response"
-		err = errors.New(eMsg)
+	if err != nil {
+		clog.WithError(err).Error("error parsing acs page")
+		err = acsParseError(err)
 		return
 	}
-	resp.ThreeDSecureNumber = firstPart[:index2]
+	resp.ThreeDSecureNumber = page.ThreeDSecureNumber
 	clog.WithFields(log.Fields{
 		"request_id": resp.ACSRequestId,
 		"number":     resp.ThreeDSecureNumber,
@@ -411,382 +504,574 @@ func (s *service) step2part2SubmitACS(ctx context.Context, pLog *log.Entry, mdOr
 	return
 }
 
-func (s *service) step2part3ACSSendPassword(ctx context.Context, pLog *log.Entry, acsRequestId, acsUrl string) (attemptsLeft int, err error) {
+func (s *service) step2part3ACSSendPassword(ctx context.Context, pLog *log.Entry, client *http.Client, acsRequestId, acsUrl string) (attemptsLeft int, err error) {
 	clog := pLog.WithField("part", "Part 3. ACS Send Password")
 
 	clog.WithField("acsUrl", acsUrl).Debug("Submitting Send Password")
-	client := s.generateClient()
 	form := url.Values{}
 	form.Add("authForm", "authForm")
 	form.Add("request_id", acsRequestId)
 	form.Add("sendPasswordButton", "Send password")
 
-	var res *http.Response
-	var r *http.Request
 	var data []byte
-
-	r, err = http.NewRequestWithContext(ctx, http.MethodPost, acsUrl, strings.NewReader(form.Encode()))
+	_, data, err = s.postForm(ctx, clog, client, PartACSSendPassword, acsUrl, form)
 	if err != nil {
-		eMsg := "error creating http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
 		return
 	}
-	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err = client.Do(r)
+	var page *acs.ACSPage
+	page, err = acs.ParseString(string(data))
 	if err != nil {
-		eMsg := "error making http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
+		clog.WithError(err).Error("error parsing acs page")
+		err = acsParseError(err)
 		return
 	}
-	if res.StatusCode != http.StatusOK {
-		eMsg := fmt.Sprintf("invalid http status code: %d", res.StatusCode)
-		clog.Error(eMsg)
-		err = errors.New(eMsg)
+	if !page.Has(acs.FieldResendAttempts) {
+		// may be no more attempts left
+		attemptsLeft = 0
+		clog.WithError(page.Require(acs.FieldResendAttempts)).Info("resend attempts were not found in response")
 		return
 	}
-	data, err = io.ReadAll(res.Body)
+	attemptsLeft = page.ResendAttemptsLeft
+	clog.Info("part 3 complete")
+	return
+}
+
+func (s *service) Step3ResendCode(ctx context.Context, req ResendCodeRequest) (resp ResendCodeResponse, err error) {
+	clog := log.FromContext(ctx).WithFields(log.Fields{
+		"app":       req.Application,
+		"id":        req.Identity,
+		"operation": "Step 3. Resend Code",
+	})
+	clog.Info("Processing")
+	part := ""
+	var bank *BankProfile
+	ctx, span := s.startStepSpan(ctx, "Step3ResendCode", req.Application, req.Identity,
+		s.paymentLinks(ctx, req.Token, req.Application, req.Identity)...)
+	s.metrics.StepStarted(StepResendCode)
 	defer func() {
-		errClose := res.Body.Close()
-		if errClose != nil {
-			clog.WithError(errClose).Error("error in response.Body.Close")
+		if err != nil {
+			resp.Status = StatusFromError(err)
 		}
+		s.metrics.StepFinished(StepResendCode, bank.label(), resp.Status)
+		err = operationError(StepResendCode, part, err)
+		endStepSpan(span, bank, resp.Status, err)
 	}()
+	resp.Status = HackResponseStatusOtherError
+	// as given, before fields are taken from session
+	fields := req.fields()
 
-	rawResponse := string(data)
-	clog.WithField("raw", rawResponse).Debug("Response received")
+	var session Session
+	if req.Token != "" {
+		part = PartSession
+		session, err = s.loadSession(ctx, req.Token, req.Application, req.Identity)
+		if err != nil {
+			eMsg := "error loading session"
+			clog.WithError(err).Error(eMsg)
+			err = errors.Wrap(err, eMsg)
+			return
+		}
+		if session.Step == SessionStepCompleted {
+			err = ErrPaymentCompleted
+			clog.WithError(err).Error("payment of session is completed")
+			return
+		}
+		if session.Step != SessionStepCardSubmitted {
+			eMsg := "card was not submitted in session"
+			clog.WithField("step", session.Step).Error(eMsg)
+			err = errors.New(eMsg)
+			return
+		}
+		req.ACSRequestId = session.ACSRequestId
+		req.ACSSessionUrl = session.ACSSessionUrl
+		clog = clog.WithField("md-order", session.MDOrder)
+	}
+	part = PartBank
+	bank, err = s.bankByName(session.Bank)
 	if err != nil {
-		eMsg := "error reading http response"
+		eMsg := "error choosing bank"
 		clog.WithError(err).Error(eMsg)
 		err = errors.Wrap(err, eMsg)
 		return
 	}
-	// parse html
-	index1 := strings.Index(rawResponse, ThreeDSecurePasswordAttemptsBegin)
-	if index1 == -1 {
-		// may be no more attempts left
-		attemptsLeft = 0
-		eMsg := "'ThreeDSecurePasswordAttemptsBegin' was not found in response"
-		clog.Info(eMsg)
+	clog = clog.WithField("bank", bank.Name)
+	part = PartRequest
+	err = bank.validator.check(StepResendCode, fields)
+	if err != nil {
+		clog.WithError(err).Warn("request is not valid")
 		return
 	}
-	index1 += len(ThreeDSecurePasswordAttemptsBegin)
-	firstPart := rawResponse[index1:]
-	index2 := strings.Index(firstPart, ThreeDSecurePasswordAttemptsEnd)
-	strAttemptsLeft := firstPart[:index2]
-	attemptsLeft, err = strconv.Atoi(strAttemptsLeft)
+	ctx, cancel := stepContext(ctx, s.timeoutsFor(bank).ResendCode)
+	defer cancel()
+	ctx = withDestinationPolicy(ctx, bank.policy)
+	part = PartDestination
+	err = bank.checkDestination(req.ACSSessionUrl)
 	if err != nil {
-		eMsg := "error parsing attempts left"
-		clog.WithField("attempts-left", strAttemptsLeft).WithError(err).Error(eMsg)
+		eMsg := "unapproved acs session url"
+		clog.WithError(err).Error(eMsg)
 		err = errors.Wrap(err, eMsg)
 		return
 	}
-	clog.Info("part 3 complete")
-	return
-}
-
-func (s *service) Step3ResendCode(ctx context.Context, req ResendCodeRequest) (resp ResendCodeResponse, err error) {
-	clog := log.WithFields(log.Fields{
-		"app":       req.Application,
-		"id":        req.Identity,
-		"operation": "Step 3. Resend Code",
-	})
-	clog.Info("Processing")
-	resp.Status = HackResponseStatusOtherError
+	jar := newPaymentJar(session.Cookies)
+	defer s.updateSession(ctx, clog, session, jar)
 
 	clog.WithField("acsUrl", req.ACSSessionUrl).Debug("Submitting Send Password")
-	client := s.generateClient()
+	client := s.generateClient(bank, jar)
 	form := url.Values{}
 	form.Add("authForm", "authForm")
 	form.Add("request_id", req.ACSRequestId)
 	form.Add("pwdInputVisible", "")
 	form.Add("resendPasswordLink", "resendPasswordLink")
 
-	var res *http.Response
-	var r *http.Request
+	part = PartACSResendPassword
 	var data []byte
-
-	r, err = http.NewRequestWithContext(ctx, http.MethodPost, req.ACSSessionUrl, strings.NewReader(form.Encode()))
+	_, data, err = s.postForm(ctx, clog, client, PartACSResendPassword, req.ACSSessionUrl, form)
 	if err != nil {
-		eMsg := "error creating http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
 		return
 	}
-	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err = client.Do(r)
+	var page *acs.ACSPage
+	page, err = acs.ParseString(string(data))
 	if err != nil {
-		eMsg := "error making http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
+		clog.WithError(err).Error("error parsing acs page")
+		err = acsParseError(err)
 		return
 	}
-	if res.StatusCode != http.StatusOK {
-		eMsg := fmt.Sprintf("invalid http status code: %d", res.StatusCode)
-		clog.Error(eMsg)
-		err = errors.New(eMsg)
+	if !page.Has(acs.FieldResendAttempts) {
+		// may be no more attempts left
+		resp.Status = HackResponseStatusOk
+		resp.ResendAttemptsLeft = 0
+		clog.WithError(page.Require(acs.FieldResendAttempts)).Info("resend attempts were not found in response")
 		return
 	}
-	data, err = io.ReadAll(res.Body)
+	resp.ResendAttemptsLeft = page.ResendAttemptsLeft
+	resp.Status = HackResponseStatusOk
+	return
+}
+
+func (s *service) Step4ConfirmPayment(ctx context.Context, req ConfirmPaymentRequest) (resp ConfirmPaymentResponse, err error) {
+	clog := log.FromContext(ctx).WithFields(log.Fields{
+		"app":       req.Application,
+		"id":        req.Identity,
+		"operation": "Step 4. Confirm Payment",
+	})
+	clog.Info("Processing")
+	part := ""
+	var bank *BankProfile
+	ctx, span := s.startStepSpan(ctx, "Step4ConfirmPayment", req.Application, req.Identity,
+		s.paymentLinks(ctx, req.Token, req.Application, req.Identity)...)
+	s.metrics.StepStarted(StepConfirmPayment)
 	defer func() {
-		errClose := res.Body.Close()
-		if errClose != nil {
-			clog.WithError(errClose).Error("error in response.Body.Close")
+		if err != nil {
+			resp.Status = StatusFromError(err)
 		}
+		s.metrics.StepFinished(StepConfirmPayment, bank.label(), resp.Status)
+		err = operationError(StepConfirmPayment, part, err)
+		endStepSpan(span, bank, resp.Status, err)
 	}()
+	resp.Status = HackResponseStatusOtherError
+	// as given, before fields are taken from session
+	fields := req.fields()
 
-	rawResponse := string(data)
-	clog.WithField("raw", rawResponse).Debug("Response received")
+	var session Session
+	if req.Token != "" {
+		part = PartSession
+		session, err = s.loadSession(ctx, req.Token, req.Application, req.Identity)
+		if err != nil {
+			eMsg := "error loading session"
+			clog.WithError(err).Error(eMsg)
+			err = errors.Wrap(err, eMsg)
+			return
+		}
+		if session.Step == SessionStepCompleted {
+			err = ErrPaymentCompleted
+			clog.WithError(err).Error("payment of session is completed")
+			return
+		}
+		if session.Step != SessionStepCardSubmitted {
+			eMsg := "card was not submitted in session"
+			clog.WithField("step", session.Step).Error(eMsg)
+			err = errors.New(eMsg)
+			return
+		}
+		req.MDOrder = session.MDOrder
+		req.ACSRequestId = session.ACSRequestId
+		req.ACSSessionUrl = session.ACSSessionUrl
+		req.TerminateUrl = session.TerminateUrl
+	}
+	clog = clog.WithField("md-order", req.MDOrder)
+	part = PartBank
+	bank, err = s.bankByName(session.Bank)
 	if err != nil {
-		eMsg := "error reading http response"
+		eMsg := "error choosing bank"
 		clog.WithError(err).Error(eMsg)
 		err = errors.Wrap(err, eMsg)
 		return
 	}
-	// parse html
-	index1 := strings.Index(rawResponse, ThreeDSecurePasswordAttemptsBegin)
-	if index1 == -1 {
-		// may be no more attempts left
-		resp.Status = HackResponseStatusOk
-		resp.ResendAttemptsLeft = 0
-		eMsg := "'ThreeDSecurePasswordAttemptsBegin' was not found in response"
-		clog.Info(eMsg)
+	clog = clog.WithField("bank", bank.Name)
+	part = PartRequest
+	err = bank.validator.check(StepConfirmPayment, fields)
+	if err != nil {
+		clog.WithError(err).Warn("request is not valid")
 		return
 	}
-	index1 += len(ThreeDSecurePasswordAttemptsBegin)
-	firstPart := rawResponse[index1:]
-	index2 := strings.Index(firstPart, ThreeDSecurePasswordAttemptsEnd)
-	strAttemptsLeft := firstPart[:index2]
-	resp.ResendAttemptsLeft, err = strconv.Atoi(strAttemptsLeft)
+	ctx, cancel := stepContext(ctx, s.timeoutsFor(bank).ConfirmPayment)
+	defer cancel()
+	ctx = withDestinationPolicy(ctx, bank.policy)
+	part = PartDestination
+	err = bank.checkDestination(req.ACSSessionUrl, req.TerminateUrl)
 	if err != nil {
-		resp.Status = HackResponseStatusOtherError
-		eMsg := "error parsing attempts left"
-		clog.WithField("attempts-left", strAttemptsLeft).WithError(err).Error(eMsg)
+		eMsg := "unapproved acs session or terminate url"
+		clog.WithError(err).Error(eMsg)
 		err = errors.Wrap(err, eMsg)
 		return
 	}
-	resp.Status = HackResponseStatusOk
-	return
-}
-
-func (s *service) Step4ConfirmPayment(ctx context.Context, req ConfirmPaymentRequest) (resp ConfirmPaymentResponse, err error) {
-	clog := log.WithFields(log.Fields{
-		"app":       req.Application,
-		"id":        req.Identity,
-		"operation": "Step 4. Confirm Payment",
-	})
-	clog.Info("Processing")
-	resp.Status = HackResponseStatusOtherError
+	jar := newPaymentJar(session.Cookies)
+	client := s.generateClient(bank, jar)
 
 	// submit otp
 	var paResponse string
 	var currentAttempt, totalAttempts int
-	paResponse, currentAttempt, totalAttempts, err = s.step4Part1SubmitPassword(ctx, clog, req.ACSRequestId,
+	part = PartACSSubmitPassword
+	paResponse, currentAttempt, totalAttempts, err = s.step4Part1SubmitPassword(ctx, clog, client, req.ACSRequestId,
 		req.ACSSessionUrl, req.OneTimePassword)
 	clog.WithFields(log.Fields{
-		"pa-resp":        paResponse,
-		"cur-attempt":    currentAttempt,
-		"total-attempts": totalAttempts,
-		"resp-err":       err,
+		"pa-resp-received": paResponse != "",
+		"cur-attempt":      currentAttempt,
+		"total-attempts":   totalAttempts,
+		"resp-err":         err,
 	}).Info("step4Part1 SubmitPassword results")
 	// check submit otp response
 	// if ok, submit terminate url
-	if err == ErrWrongPasswordOperationCancelled {
-		eMsg := "error in part 1, wrong password operation cancelled"
-		clog.WithError(err).Error(eMsg)
-		err = nil
-		resp.Status = HackResponseStatusOperationCancelled
+	if errors.Is(err, ErrWrongPasswordOperationCancelled) {
+		clog.WithError(err).Error("error in part 1, wrong password operation cancelled")
+		s.completeSession(ctx, clog, session)
 		return
 	} else if err != nil {
-		eMsg := "error in part 1"
-		clog.WithError(err).Error(eMsg)
-		err = nil
-		resp.Status = HackResponseStatusOtherError
+		clog.WithError(err).Error("error in part 1")
 		return
 	}
 	if paResponse == "" {
 		resp.Status = HackResponseStatusWrongOTP
 		resp.CurrentAttempt = currentAttempt
 		resp.TotalAttempts = totalAttempts
+		s.updateSession(ctx, clog, session, jar)
 		return
 	}
 	// paResponse exists completing
-	resp.FinalUrl, err = s.step4Part2CompleteOperation(ctx, clog, req.MDOrder, paResponse, req.TerminateUrl)
+	part = PartCompleteOperation
+	resp.FinalUrl, err = s.step4Part2CompleteOperation(ctx, clog, client, bank.policy, req.MDOrder, paResponse, req.TerminateUrl)
 	if err != nil {
-		eMsg := "error in part 2"
+		clog.WithError(err).Error("error in part 2")
+		return
+	}
+	outcome := bank.paymentOutcome(resp.FinalUrl, session)
+	resp.Outcome = &outcome
+	clog.WithFields(log.Fields{
+		"result":     outcome.Result,
+		"order-id":   outcome.OrderId,
+		"error-code": outcome.ErrorCode,
+	}).Info("payment outcome")
+	if outcome.OrderId != "" && !strings.EqualFold(outcome.OrderId, req.MDOrder) {
+		clog.WithField("order-id", outcome.OrderId).Warn("order id of final url differs from md-order")
+	}
+	resp.Status = HackResponseStatusOk
+	s.completeSession(ctx, clog, session)
+	return
+}
+
+func (s *service) Step5OrderStatus(ctx context.Context, req OrderStatusRequest) (resp OrderStatusResponse, err error) {
+	clog := log.FromContext(ctx).WithFields(log.Fields{
+		"app":       req.Application,
+		"id":        req.Identity,
+		"operation": "Step 5. Order Status",
+	})
+	clog.Info("Processing")
+	part := ""
+	var bank *BankProfile
+	ctx, span := s.startStepSpan(ctx, "Step5OrderStatus", req.Application, req.Identity,
+		s.paymentLinks(ctx, req.Token, req.Application, req.Identity)...)
+	s.metrics.StepStarted(StepOrderStatus)
+	defer func() {
+		if err != nil {
+			resp.Status = StatusFromError(err)
+		}
+		s.metrics.StepFinished(StepOrderStatus, bank.label(), resp.Status)
+		err = operationError(StepOrderStatus, part, err)
+		endStepSpan(span, bank, resp.Status, err)
+	}()
+	resp.Status = HackResponseStatusOtherError
+	// as given, before fields are taken from session
+	fields := req.fields()
+
+	var session Session
+	if req.Token != "" {
+		part = PartSession
+		// session of any step will do, order status may be asked before payment is completed as well
+		session, err = s.loadSession(ctx, req.Token, req.Application, req.Identity)
+		if err != nil {
+			eMsg := "error loading session"
+			clog.WithError(err).Error(eMsg)
+			err = errors.Wrap(err, eMsg)
+			return
+		}
+		req.MDOrder = session.MDOrder
+	}
+	clog = clog.WithField("md-order", req.MDOrder)
+	part = PartBank
+	bank, err = s.bankByName(session.Bank)
+	if err != nil {
+		eMsg := "error choosing bank"
 		clog.WithError(err).Error(eMsg)
 		err = errors.Wrap(err, eMsg)
-		resp.Status = HackResponseStatusOtherError
+		return
+	}
+	clog = clog.WithField("bank", bank.Name)
+	part = PartRequest
+	err = bank.validator.check(StepOrderStatus, fields)
+	if err != nil {
+		clog.WithError(err).Warn("request is not valid")
+		return
+	}
+	ctx, cancel := stepContext(ctx, s.timeoutsFor(bank).OrderStatus)
+	defer cancel()
+	ctx = withDestinationPolicy(ctx, bank.policy)
+	resp.MDOrder = req.MDOrder
+	client := s.generateClient(bank, nil)
+	form := url.Values{}
+	if bank.MerchantUserName != "" {
+		form.Add("userName", bank.MerchantUserName)
+		form.Add("password", bank.MerchantPassword)
+	}
+	form.Add("orderId", req.MDOrder)
+
+	part = PartOrderStatus
+	if !bank.breaker.allow() {
+		err = ErrBankUnavailable
+		clog.WithError(err).Warn("request to bank is not made")
+		return
+	}
+	var data []byte
+	_, data, err = s.retryForm(ctx, clog, client, s.retryPolicies.OrderStatus, isRetryable, PartOrderStatus, bank.orderStatusUrl(), form)
+	bank.breaker.done(err)
+	if err != nil {
+		return
+	}
+	var bpcResponse response.OrderStatusExtended
+	err = json.Unmarshal(data, &bpcResponse)
+	if err != nil {
+		clog.WithError(err).Error("error parsing json response")
+		err = &ParseError{Page: PageOrderStatus, Err: err}
+		return
+	}
+	if bpcResponse.ErrorCode != 0 {
+		// e.g. order is not known or merchant credentials are wrong, catalogue is for card errors only
+		err = &BankRejectedError{Code: int(bpcResponse.ErrorCode), Message: bpcResponse.ErrorMessage, Reason: classify.ReasonUnknown}
+		clog.WithError(err).Error("error in response")
+		return
+	}
+	if bpcResponse.OrderStatus == nil {
+		clog.Error("invalid bpc response")
+		err = &ParseError{Page: PageOrderStatus, Field: "orderStatus", Err: errors.New("order status is missing")}
+		return
+	}
+	var known bool
+	resp.Outcome, known = orderOutcomeOf(*bpcResponse.OrderStatus)
+	if !known {
+		clog.WithField("order-status", *bpcResponse.OrderStatus).Error("unknown order status")
+		err = &ParseError{Page: PageOrderStatus, Field: "orderStatus", Err: errors.Errorf("unknown order status %d", *bpcResponse.OrderStatus)}
+		return
+	}
+	resp.Status = HackResponseStatusOk
+	resp.OrderNumber = bpcResponse.OrderNumber
+	resp.ActionCode = bpcResponse.ActionCode
+	resp.ActionCodeDescription = bpcResponse.ActionCodeDescription
+	resp.Amount = bpcResponse.Amount
+	resp.DepositedAmount = bpcResponse.PaymentAmountInfo.DepositedAmount
+	resp.RefundedAmount = bpcResponse.PaymentAmountInfo.RefundedAmount
+	resp.Currency = bpcResponse.Currency
+	clog.WithFields(log.Fields{
+		"outcome":     resp.Outcome,
+		"action-code": resp.ActionCode,
+	}).Info("order status received")
+	return
+}
+
+func (s *service) InspectSession(ctx context.Context, req InspectSessionRequest) (resp InspectSessionResponse, err error) {
+	resp.Status = HackResponseStatusOtherError
+	var session Session
+	session, err = s.loadSession(ctx, req.Token, req.Application, req.Identity)
+	if err != nil {
+		err = errors.Wrap(err, "error loading session")
+		resp.Status = StatusFromError(err)
 		return
 	}
 	resp.Status = HackResponseStatusOk
+	resp.MDOrder = session.MDOrder
+	resp.Step = session.Step
+	resp.ExpirationTs = session.ExpiresAt.Unix()
+	resp.Cookies = session.Cookies
 	return
 }
 
-func (s *service) step4Part1SubmitPassword(ctx context.Context, pLog *log.Entry, acsRequestId, acsUrl, password string) (paResponse string, currentAttempt int, totalAttempts int, err error) {
+// completeSession marks session of payment which can not be continued anymore,
+// it is kept for CompletedSessionTTL at least, so order status can be looked up with token
+func (s *service) completeSession(ctx context.Context, clog *log.Entry, session Session) {
+	if session.Token == "" {
+		return
+	}
+	s.openPayments.closed(session.Token)
+	now := time.Now()
+	session.Step = SessionStepCompleted
+	session.ACSRequestId = ""
+	session.ACSSessionUrl = ""
+	session.TerminateUrl = ""
+	session.Cookies = nil
+	session.UpdatedAt = now
+	if session.ExpiresAt.Before(now.Add(CompletedSessionTTL)) {
+		session.ExpiresAt = now.Add(CompletedSessionTTL)
+	}
+	err := s.sessions.Save(ctx, session)
+	if err != nil {
+		clog.WithError(err).Error("error saving completed session")
+	}
+}
+
+func (s *service) step4Part1SubmitPassword(ctx context.Context, pLog *log.Entry, client *http.Client, acsRequestId, acsUrl, password string) (paResponse string, currentAttempt int, totalAttempts int, err error) {
 	clog := pLog.WithField("part", "Part 1. ACS Submit Password")
 
 	clog.WithField("acsUrl", acsUrl).Debug("Submitting Password")
-	client := s.generateClient()
 	form := url.Values{}
 	form.Add("request_id", acsRequestId)
 	form.Add("authForm", "authForm")
 	form.Add("pwdInputVisible", password)
 	form.Add("submitPasswordButton", "Submit")
 
-	var res *http.Response
-	var r *http.Request
 	var data []byte
-
-	r, err = http.NewRequestWithContext(ctx, http.MethodPost, acsUrl, strings.NewReader(form.Encode()))
+	_, data, err = s.postForm(ctx, clog, client, PartACSSubmitPassword, acsUrl, form)
 	if err != nil {
-		eMsg := "error creating http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
 		return
 	}
-	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	res, err = client.Do(r)
+	var page *acs.ACSPage
+	page, err = acs.ParseString(string(data))
 	if err != nil {
-		eMsg := "error making http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		return
-	}
-	if res.StatusCode != http.StatusOK {
-		eMsg := fmt.Sprintf("invalid http status code: %d", res.StatusCode)
-		clog.Error(eMsg)
-		err = errors.New(eMsg)
+		clog.WithError(err).Error("error parsing acs page")
+		err = acsParseError(err)
 		return
 	}
-	data, err = io.ReadAll(res.Body)
-	defer func() {
-		errClose := res.Body.Close()
-		if errClose != nil {
-			clog.WithError(errClose).Error("error in response.Body.Close")
-		}
-	}()
-
-	rawResponse := string(data)
-	clog.WithField("raw", rawResponse).Debug("Response received")
-	if err != nil {
-		eMsg := "error reading http response"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		return
-	}
-	var index1, index2, index3 int
-	var firstPart, secondPart string
-	// parse html
-	index1 = strings.Index(rawResponse, ThreeDSecureWrongPasswordFinal)
-	if index1 > 0 {
+	if page.Cancelled {
 		// wrong password, operation cancelled
 		eMsg := "wrong password, operation cancelled"
 		clog.Info(eMsg)
 		err = ErrWrongPasswordOperationCancelled
 		return
 	}
-	index1 = strings.Index(rawResponse, ThreeDSecurePaymentResponseBegin)
-	if index1 == -1 {
-		eMsg := "'ThreeDSecurePaymentResponseBegin' was not found in response, maybe wrong password"
-		clog.Info(eMsg)
-		// wrong password
-		index1 = strings.Index(rawResponse, ThreeDSecureWrongPasswordAttemptBegin)
-		if index1 == -1 {
-			// may be no more attempts left
-			eMsg := "'ThreeDSecureWrongPasswordAttemptBegin' was not found in response"
-			clog.Info(eMsg)
-			return
-		}
-		index1 += len(ThreeDSecureWrongPasswordAttemptBegin)
-		firstPart = rawResponse[index1:]
-		index2 = strings.Index(firstPart, ThreeDSecureWrongPasswordAttemptMiddle)
-		strCurrentAttempt := firstPart[:index2]
-		index2 += len(ThreeDSecureWrongPasswordAttemptMiddle)
-		secondPart = firstPart[index2:]
-		index3 = strings.Index(secondPart, ThreeDSecureWrongPasswordAttemptEnd)
-		strTotalAttempts := secondPart[:index3]
-		currentAttempt, err = strconv.Atoi(strCurrentAttempt)
-		if err != nil {
-			eMsg := "error parsing wrong password current attempts"
-			clog.WithField("current-attempt", strCurrentAttempt).WithError(err).Error(eMsg)
-			err = errors.Wrap(err, eMsg)
-			return
-		}
-		totalAttempts, err = strconv.Atoi(strTotalAttempts)
-		if err != nil {
-			eMsg := "error parsing wrong password total attempts"
-			clog.WithField("total-attempts", strTotalAttempts).WithError(err).Error(eMsg)
-			err = errors.Wrap(err, eMsg)
-			return
-		}
+	if page.Has(acs.FieldPaymentResponse) {
+		paResponse = page.PaymentResponse
+		return
+	}
+	clog.Info("PaRes was not found in response, maybe wrong password")
+	if !page.Has(acs.FieldWrongPasswordAttempts) {
+		// may be no more attempts left
+		clog.Info("wrong password attempts were not found in response")
 		return
-
 	}
-	index1 += len(ThreeDSecurePaymentResponseBegin)
-	firstPart = rawResponse[index1:]
-	index2 = strings.Index(firstPart, ThreeDSecurePaymentResponseEnd)
-	paResponse = firstPart[:index2]
+	currentAttempt = page.WrongPasswordAttempt
+	totalAttempts = page.WrongPasswordTotalAttempts
 	return
 }
 
-func (s *service) step4Part2CompleteOperation(ctx context.Context, pLog *log.Entry, mdOrder, paResponse, termUrl string) (finalUrl string, err error) {
+func (s *service) step4Part2CompleteOperation(ctx context.Context, pLog *log.Entry, client *http.Client, policy *destinationPolicy, mdOrder, paResponse, termUrl string) (finalUrl string, err error) {
 	clog := pLog.WithField("part", "Part 2. complete operation")
 
 	clog.WithField("termUrl", termUrl).Debug("processing")
-	client := s.generateClient()
 	form := url.Values{}
 	form.Add("MD", mdOrder)
 	form.Add("PaRes", paResponse)
 
+	// terminate url redirects to page of merchant, page out of bank hosts is not requested
+	merchantClient := *client
+	merchantClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if policy.checkUrl(req.URL.String()) != nil {
+			return http.ErrUseLastResponse
+		}
+		return policy.checkRedirect(req, via)
+	}
 	var res *http.Response
-	var r *http.Request
-
-	r, err = http.NewRequestWithContext(ctx, http.MethodPost, termUrl, strings.NewReader(form.Encode()))
+	res, _, err = s.postForm(ctx, clog, &merchantClient, PartCompleteOperation, termUrl, form)
 	if err != nil {
-		eMsg := "error creating http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
 		return
 	}
-	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	finalUrl = res.Request.URL.String()
+	if isRedirect(res) {
+		var location *url.URL
+		location, err = res.Location()
+		if err != nil {
+			eMsg := "error in redirect location"
+			clog.WithError(err).Error(eMsg)
+			err = errors.Wrap(err, eMsg)
+			return
+		}
+		finalUrl = location.String()
+	}
+	return
+}
 
-	res, err = client.Do(r)
-	if err != nil {
-		eMsg := "error making http request"
-		clog.WithError(err).Error(eMsg)
-		err = errors.Wrap(err, eMsg)
-		return
+// NewService creates service working with banks, payments without session are processed with the first bank,
+// by default sessions are kept in memory, requests time out after DefaultTimeout
+// and are retried according to DefaultRetryPolicies
+func NewService(banks []BankProfile, opts ...Option) Service {
+	s := &service{
+		timeout:         DefaultTimeout,
+		banks:           make([]BankProfile, len(banks)),
+		transportConfig: DefaultTransportConfig(),
+		retryPolicies:   DefaultRetryPolicies(),
+		metrics:         noopMetrics{},
+		catalogue:       classify.Default(),
+		tracerProvider:  trace.NewNoopTracerProvider(),
+		breakerConfig:   DefaultBreakerConfig(),
 	}
-	if res.StatusCode != http.StatusOK {
-		eMsg := fmt.Sprintf("invalid http status code: %d", res.StatusCode)
-		clog.Error(eMsg)
-		err = errors.New(eMsg)
-		return
+	copy(s.banks, banks)
+	for i := range s.banks {
+		policy, err := newDestinationPolicy(&s.banks[i])
+		if err != nil {
+			// only public addresses of bank hosts are reachable then
+			log.WithError(err).WithField("bank", s.banks[i].Name).Error("error in destination policy")
+			policy = &destinationPolicy{hosts: s.banks[i].destinationHosts()}
+		}
+		s.banks[i].policy = policy
+		s.banks[i].returnPatterns = newUrlPatterns(s.banks[i].ReturnUrls)
+		s.banks[i].failPatterns = newUrlPatterns(s.banks[i].FailUrls)
 	}
-	if res.Request == nil {
-		eMsg := "request of response is nil"
-		clog.Error(eMsg)
-		err = errors.New(eMsg)
-		return
+	for _, opt := range opts {
+		opt(s)
 	}
-	if res.Request.URL == nil {
-		eMsg := "url of request of response is nil"
-		clog.Error(eMsg)
-		err = errors.New(eMsg)
-		return
+	if s.sessions == nil {
+		s.sessions = NewMemorySessionStore()
 	}
-	finalUrl = res.Request.URL.String()
-	return
+	for i := range s.banks {
+		// connection dialed under allowed networks of one bank is never reused by another
+		s.banks[i].transport = newTransport(s.transportConfig)
+	}
+	s.breakers = newBreakers(s.breakerConfig, s.banks)
+	s.compileValidators()
+	s.openPayments = newOpenPayments(s.metrics)
+	s.tracer = s.tracerProvider.Tracer(tracerName)
+	return s
 }
 
-func NewService(baseMpiUrl string, timeout time.Duration) Service {
-	return &service{
-		timeout:    timeout,
-		baseMpiUrl: baseMpiUrl,
+// compileValidators compiles validation rules of every bank, rules which do not compile are ignored
+func (s *service) compileValidators() {
+	rules := DefaultValidationRules().override(s.validationRules)
+	base, err := newValidator(rules)
+	if err != nil {
+		log.WithError(err).Error("error in validation rules, using default ones")
+		rules = DefaultValidationRules()
+		base, _ = newValidator(rules)
+	}
+	for i := range s.banks {
+		s.banks[i].validator, err = newValidator(rules.override(s.banks[i].Validation))
+		if err != nil {
+			log.WithError(err).WithField("bank", s.banks[i].Name).Error("error in validation rules of bank")
+			s.banks[i].validator = base
+		}
 	}
 }
@@ -0,0 +1,825 @@
+package pkg_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"ykjam/bpchack/pkg"
+	"ykjam/bpchack/pkg/bpc/classify"
+	"ykjam/bpchack/pkg/bpc/mock"
+)
+
+const (
+	testApplication = "testapp"
+	testIdentity    = "user42"
+	testCardNumber  = "4111111111111111"
+	testCardExpiry  = "203012"
+	testNameOnCard  = "TEST CARDHOLDER"
+)
+
+type serviceEnv struct {
+	bank    *httptest.Server
+	service pkg.Service
+}
+
+// serviceEnvConfig is what service of env is created with
+type serviceEnvConfig struct {
+	// url of mock bank
+	bankUrl string
+	// profile of mock bank
+	profile pkg.BankProfile
+	// profiles configured before mock bank
+	banksBefore []pkg.BankProfile
+	options     []pkg.Option
+}
+
+type serviceEnvOption func(c *serviceEnvConfig)
+
+// withBankProfile changes profile of mock bank, url of mock is given to build urls of bank
+func withBankProfile(change func(profile *pkg.BankProfile, bankUrl string)) serviceEnvOption {
+	return func(c *serviceEnvConfig) {
+		change(&c.profile, c.bankUrl)
+	}
+}
+
+func withBanksBefore(profiles ...pkg.BankProfile) serviceEnvOption {
+	return func(c *serviceEnvConfig) {
+		c.banksBefore = append(c.banksBefore, profiles...)
+	}
+}
+
+func withServiceOptions(options ...pkg.Option) serviceEnvOption {
+	return func(c *serviceEnvConfig) {
+		c.options = append(c.options, options...)
+	}
+}
+
+func newServiceEnv(t *testing.T, scenarioName string, options ...serviceEnvOption) *serviceEnv {
+	t.Helper()
+	scenario, ok := mock.ScenarioByName(scenarioName)
+	if !ok {
+		t.Fatalf("unknown scenario %s", scenarioName)
+	}
+	return newServiceEnvWithScenario(t, scenario, options...)
+}
+
+func newServiceEnvWithScenario(t *testing.T, scenario mock.Scenario, options ...serviceEnvOption) *serviceEnv {
+	t.Helper()
+	bank := httptest.NewServer(mock.NewServer(scenario))
+	t.Cleanup(bank.Close)
+	c := serviceEnvConfig{
+		bankUrl: bank.URL,
+		profile: pkg.BankProfile{
+			Name:            "mock",
+			BaseMpiUrl:      bank.URL + mock.MPIPath,
+			AllowedNetworks: []string{"127.0.0.0/8"},
+		},
+		options: []pkg.Option{pkg.WithTimeout(5 * time.Second)},
+	}
+	for _, option := range options {
+		option(&c)
+	}
+	return &serviceEnv{
+		bank:    bank,
+		service: pkg.NewService(append(c.banksBefore, c.profile), c.options...),
+	}
+}
+
+func (e *serviceEnv) paymentUrl(mdOrder string) string {
+	return e.bank.URL + "/payment/merchants/mock/payment_ru.html?mdOrder=" + mdOrder
+}
+
+func (e *serviceEnv) start(t *testing.T) pkg.StartHackResponse {
+	t.Helper()
+	resp, err := e.service.Step1StartHack(context.Background(), pkg.StartHackRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		PaymentUrl:  e.paymentUrl("0a1b2c3d-0000-4000-8000-000000000001"),
+	})
+	if err != nil {
+		t.Fatalf("step1 start hack failed: %v", err)
+	}
+	if resp.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("step1 status = %s, want %s", resp.Status, pkg.HackResponseStatusOk)
+	}
+	return resp
+}
+
+func (e *serviceEnv) submitCard(t *testing.T, token, cvc string) pkg.SubmitCardResponse {
+	t.Helper()
+	resp, err := e.service.Step2SubmitCard(context.Background(), pkg.SubmitCardRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		Token:       token,
+		CardNumber:  testCardNumber,
+		Expiry:      testCardExpiry,
+		NameOnCard:  testNameOnCard,
+		CVCCode:     cvc,
+	})
+	if err != nil && !pkg.IsBankAnswer(err) {
+		t.Fatalf("step2 submit card failed: %v", err)
+	}
+	return resp
+}
+
+func (e *serviceEnv) confirm(t *testing.T, token, otp string) pkg.ConfirmPaymentResponse {
+	t.Helper()
+	resp, err := e.service.Step4ConfirmPayment(context.Background(), pkg.ConfirmPaymentRequest{
+		Application:     testApplication,
+		Identity:        testIdentity,
+		Token:           token,
+		OneTimePassword: otp,
+	})
+	if err != nil && !pkg.IsBankAnswer(err) {
+		t.Fatalf("step4 confirm payment failed: %v", err)
+	}
+	return resp
+}
+
+func TestServiceWorkflowOk(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioSuccess)
+	step1 := e.start(t)
+	if step1.Token == "" {
+		t.Fatal("step1 token is empty")
+	}
+	if step1.IsCVCRequired {
+		t.Error("step1 cvc should not be required")
+	}
+	step2 := e.submitCard(t, step1.Token, "")
+	if step2.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("step2 status = %s, want %s", step2.Status, pkg.HackResponseStatusOk)
+	}
+	if step2.ResendAttemptsLeft != 3 {
+		t.Errorf("step2 resend attempts left = %d, want 3", step2.ResendAttemptsLeft)
+	}
+	if step2.ACSRequestId != "" || step2.ACSSessionUrl != "" || step2.TerminateUrl != "" {
+		t.Errorf("step2 = %v, want acs parameters kept in session", step2)
+	}
+	step3, err := e.service.Step3ResendCode(context.Background(), pkg.ResendCodeRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		Token:       step1.Token,
+	})
+	if err != nil {
+		t.Fatalf("step3 resend code failed: %v", err)
+	}
+	if step3.Status != pkg.HackResponseStatusOk || step3.ResendAttemptsLeft != 2 {
+		t.Errorf("step3 = %v, want ok with 2 attempts left", step3)
+	}
+	step4 := e.confirm(t, step1.Token, mock.DefaultOTP)
+	if step4.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("step4 status = %s, want %s", step4.Status, pkg.HackResponseStatusOk)
+	}
+	if step4.FinalUrl == "" {
+		t.Error("step4 final url is empty")
+	}
+	// session is finished together with payment
+	step4, err = e.service.Step4ConfirmPayment(context.Background(), pkg.ConfirmPaymentRequest{
+		Application:     testApplication,
+		Identity:        testIdentity,
+		Token:           step1.Token,
+		OneTimePassword: mock.DefaultOTP,
+	})
+	if err == nil || step4.Status != pkg.HackResponseStatusAlreadyProcessed {
+		t.Errorf("repeated step4 = %v, %v, want %s", step4, err, pkg.HackResponseStatusAlreadyProcessed)
+	}
+}
+
+func TestServiceWorkflowWithoutSession(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioSuccess)
+	step1 := e.start(t)
+	ctx := context.Background()
+	step2, err := e.service.Step2SubmitCard(ctx, pkg.SubmitCardRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		MDOrder:     step1.MDOrder,
+		CardNumber:  testCardNumber,
+		Expiry:      testCardExpiry,
+		NameOnCard:  testNameOnCard,
+	})
+	if err != nil || step2.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("step2 = %v, %v", step2, err)
+	}
+	if step2.ACSRequestId == "" || step2.ACSSessionUrl == "" || step2.TerminateUrl == "" {
+		t.Errorf("step2 = %v, want acs parameters without session", step2)
+	}
+	step4, err := e.service.Step4ConfirmPayment(ctx, pkg.ConfirmPaymentRequest{
+		Application:     testApplication,
+		Identity:        testIdentity,
+		MDOrder:         step1.MDOrder,
+		ACSRequestId:    step2.ACSRequestId,
+		ACSSessionUrl:   step2.ACSSessionUrl,
+		OneTimePassword: mock.DefaultOTP,
+		TerminateUrl:    step2.TerminateUrl,
+	})
+	if err != nil || step4.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("step4 = %v, %v", step4, err)
+	}
+}
+
+func TestServiceSeveralBanks(t *testing.T) {
+	// payment urls of mock are served by the second bank only
+	e := newServiceEnv(t, mock.ScenarioSuccess, withBanksBefore(pkg.BankProfile{
+		Name:         "other",
+		BaseMpiUrl:   "https://mpi.other.invalid/mpi",
+		PaymentHosts: []string{"mpi.other.invalid"},
+	}))
+	step1 := e.start(t)
+	if step2 := e.submitCard(t, step1.Token, ""); step2.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("step2 with token = %v, want %s", step2, pkg.HackResponseStatusOk)
+	}
+	ctx := context.Background()
+	step2, err := e.service.Step2SubmitCard(ctx, pkg.SubmitCardRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		MDOrder:     step1.MDOrder,
+		CardNumber:  testCardNumber,
+		Expiry:      testCardExpiry,
+		NameOnCard:  testNameOnCard,
+	})
+	if !errors.Is(err, pkg.ErrSessionRequired) || step2.Status != pkg.HackResponseStatusInvalidRequest {
+		t.Errorf("step2 without token = %v, %v, want %v", step2, err, pkg.ErrSessionRequired)
+	}
+	step3, err := e.service.Step3ResendCode(ctx, pkg.ResendCodeRequest{
+		Application:   testApplication,
+		Identity:      testIdentity,
+		ACSRequestId:  "request-1",
+		ACSSessionUrl: e.bank.URL + "/acs/auth/otp.do",
+	})
+	if !errors.Is(err, pkg.ErrSessionRequired) || step3.Status != pkg.HackResponseStatusInvalidRequest {
+		t.Errorf("step3 without token = %v, %v, want %v", step3, err, pkg.ErrSessionRequired)
+	}
+	step5, err := e.service.Step5OrderStatus(ctx, pkg.OrderStatusRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		MDOrder:     step1.MDOrder,
+	})
+	if !errors.Is(err, pkg.ErrSessionRequired) || step5.Status != pkg.HackResponseStatusInvalidRequest {
+		t.Errorf("step5 without token = %v, %v, want %v", step5, err, pkg.ErrSessionRequired)
+	}
+	if step4 := e.confirm(t, step1.Token, mock.DefaultOTP); step4.Status != pkg.HackResponseStatusOk {
+		t.Errorf("step4 with token = %v, want %s", step4, pkg.HackResponseStatusOk)
+	}
+}
+
+func TestServiceStartHackAlreadyProcessed(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioSessionExpired)
+	resp, err := e.service.Step1StartHack(context.Background(), pkg.StartHackRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		PaymentUrl:  e.paymentUrl("0a1b2c3d-0000-4000-8000-000000000002"),
+	})
+	var expired *pkg.SessionExpiredError
+	if !errors.As(err, &expired) {
+		t.Errorf("error = %v, want SessionExpiredError", err)
+	}
+	if resp.Status != pkg.HackResponseStatusAlreadyProcessed {
+		t.Errorf("status = %s, want %s", resp.Status, pkg.HackResponseStatusAlreadyProcessed)
+	}
+	if resp.Token != "" {
+		t.Error("token must not be issued for processed order")
+	}
+}
+
+func TestServiceStartHackNetworkError(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioSuccess)
+	paymentUrl := e.paymentUrl("0a1b2c3d-0000-4000-8000-000000000003")
+	e.bank.Close()
+	resp, err := e.service.Step1StartHack(context.Background(), pkg.StartHackRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		PaymentUrl:  paymentUrl,
+	})
+	var network *pkg.NetworkError
+	if !errors.As(err, &network) {
+		t.Errorf("error = %v, want NetworkError", err)
+	}
+	var opErr *pkg.OperationError
+	if !errors.As(err, &opErr) || opErr.Step != pkg.StepStartHack || opErr.Part != pkg.PartSessionStatus {
+		t.Errorf("error = %v, want start-hack failed at session-status", err)
+	}
+	if resp.Status != pkg.HackResponseStatusNetworkError {
+		t.Errorf("status = %s, want %s", resp.Status, pkg.HackResponseStatusNetworkError)
+	}
+}
+
+func TestServiceStartHackRetriesUnavailableBank(t *testing.T) {
+	scenario, _ := mock.ScenarioByName(mock.ScenarioSuccess)
+	scenario.UnavailableStatusChecks = 2
+	e := newServiceEnvWithScenario(t, scenario)
+	e.start(t)
+
+	scenario.UnavailableStatusChecks = 3
+	e = newServiceEnvWithScenario(t, scenario)
+	resp, err := e.service.Step1StartHack(context.Background(), pkg.StartHackRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		PaymentUrl:  e.paymentUrl("0a1b2c3d-0000-4000-8000-000000000004"),
+	})
+	var unexpected *pkg.UnexpectedStatusError
+	if !errors.As(err, &unexpected) || resp.Status != pkg.HackResponseStatusOtherError {
+		t.Errorf("step1 = %v, %v, want failure after retries", resp, err)
+	}
+}
+
+func TestServiceSubmitCardDoesNotRepeatACSRequest(t *testing.T) {
+	scenario, _ := mock.ScenarioByName(mock.ScenarioSuccess)
+	scenario.UnavailableACSStarts = 1
+	e := newServiceEnvWithScenario(t, scenario)
+	step1 := e.start(t)
+	resp, err := e.service.Step2SubmitCard(context.Background(), pkg.SubmitCardRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		Token:       step1.Token,
+		CardNumber:  testCardNumber,
+		Expiry:      testCardExpiry,
+		NameOnCard:  testNameOnCard,
+	})
+	var unexpected *pkg.UnexpectedStatusError
+	if !errors.As(err, &unexpected) || unexpected.Code != http.StatusServiceUnavailable || resp.Status == pkg.HackResponseStatusOk {
+		t.Errorf("step2 = %v, %v, want failure without retry", resp, err)
+	}
+}
+
+func TestServiceStartHackBreakerOpens(t *testing.T) {
+	scenario, _ := mock.ScenarioByName(mock.ScenarioSuccess)
+	scenario.UnavailableStatusChecks = 100
+	e := newServiceEnvWithScenario(t, scenario, withServiceOptions(
+		pkg.WithRetryPolicies(pkg.RetryPolicies{}),
+		pkg.WithBreakerConfig(pkg.BreakerConfig{
+			FailureRatio:   0.5,
+			MinRequests:    2,
+			Window:         time.Minute,
+			OpenTimeout:    time.Minute,
+			HalfOpenProbes: 1,
+		})))
+	service := e.service
+	ctx := context.Background()
+	req := pkg.StartHackRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		PaymentUrl:  e.paymentUrl("0a1b2c3d-0000-4000-8000-000000000005"),
+	}
+	for i := 0; i < 2; i++ {
+		resp, _ := service.Step1StartHack(ctx, req)
+		if resp.Status != pkg.HackResponseStatusOtherError {
+			t.Fatalf("request %d status = %s, want %s", i, resp.Status, pkg.HackResponseStatusOtherError)
+		}
+	}
+	resp, err := service.Step1StartHack(ctx, req)
+	if !errors.Is(err, pkg.ErrBankUnavailable) || resp.Status != pkg.HackResponseStatusBankUnavailable {
+		t.Errorf("step1 = %v, %v, want %s", resp, err, pkg.HackResponseStatusBankUnavailable)
+	}
+	breakers, _ := service.InspectBreakers(ctx)
+	if len(breakers.Breakers) != 1 || breakers.Breakers[0].State != pkg.BreakerOpen {
+		t.Errorf("breakers = %v, want single open breaker", breakers)
+	}
+}
+
+func TestServiceStartHackUnknownBank(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioSuccess)
+	resp, err := e.service.Step1StartHack(context.Background(), pkg.StartHackRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		PaymentUrl:  "https://unknown.example.com/payment/merchants/mock/payment_ru.html?mdOrder=1",
+	})
+	if err == nil || resp.Status != pkg.HackResponseStatusUnknownBank {
+		t.Errorf("step1 = %v, %v, want %s", resp, err, pkg.HackResponseStatusUnknownBank)
+	}
+}
+
+func TestServiceStartHackLoopbackRejected(t *testing.T) {
+	e := newServiceEnvWithScenario(t, mock.Scenario{}, withBankProfile(func(profile *pkg.BankProfile, _ string) {
+		profile.AllowedNetworks = nil
+	}))
+	resp, err := e.service.Step1StartHack(context.Background(), pkg.StartHackRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		PaymentUrl:  e.paymentUrl("1"),
+	})
+	if err == nil || resp.Status != pkg.HackResponseStatusRejectedDestination {
+		t.Errorf("step1 = %v, %v, want %s", resp, err, pkg.HackResponseStatusRejectedDestination)
+	}
+}
+
+func TestServiceUnapprovedACSSessionUrl(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioSuccess)
+	ctx := context.Background()
+	tests := []struct {
+		acsSessionUrl string
+		want          pkg.HackResponseStatus
+	}{
+		{"http://169.254.169.254/latest/meta-data/", pkg.HackResponseStatusRejectedDestination},
+		{"http://internal.example.com/acs/auth/otp.do", pkg.HackResponseStatusRejectedDestination},
+		// refused by validation before destination is checked
+		{"file:///etc/passwd", pkg.HackResponseStatusInvalidRequest},
+	}
+	for _, tt := range tests {
+		resp, err := e.service.Step3ResendCode(ctx, pkg.ResendCodeRequest{
+			Application:   testApplication,
+			Identity:      testIdentity,
+			ACSRequestId:  "1",
+			ACSSessionUrl: tt.acsSessionUrl,
+		})
+		if err == nil || resp.Status != tt.want {
+			t.Errorf("step3 %s = %v, %v, want %s", tt.acsSessionUrl, resp, err, tt.want)
+		}
+	}
+}
+
+func TestServiceValidatesRequest(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioSuccess, withBankProfile(func(profile *pkg.BankProfile, _ string) {
+		profile.Validation = pkg.ValidationRules{
+			pkg.StepStartHack: {"payment-url": {Required: true, UrlSchemes: []string{"https"}}},
+		}
+	}))
+	service := e.service
+	ctx := context.Background()
+
+	_, err := service.Step1StartHack(ctx, pkg.StartHackRequest{
+		Application: testApplication,
+		Identity:    "x",
+		PaymentUrl:  e.paymentUrl("0a1b2c3d-0000-4000-8000-000000000007"),
+	})
+	var invalid *pkg.ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("step1 error = %v, want validation error", err)
+	}
+	want := []pkg.FieldError{
+		{Field: "identity", Code: pkg.CodeFieldPattern},
+		{Field: "payment-url", Code: pkg.CodeFieldUrlScheme},
+	}
+	if len(invalid.Fields) != len(want) {
+		t.Fatalf("fields = %v, want %v", invalid.Fields, want)
+	}
+	for i, f := range invalid.Fields {
+		if f.Field != want[i].Field || f.Code != want[i].Code {
+			t.Errorf("field %d = %v, want %v", i, f, want[i])
+		}
+	}
+
+	resp, err := service.Step4ConfirmPayment(ctx, pkg.ConfirmPaymentRequest{
+		Application:     testApplication,
+		Identity:        testIdentity,
+		MDOrder:         "1",
+		OneTimePassword: "12ab",
+	})
+	if !errors.As(err, &invalid) || resp.Status != pkg.HackResponseStatusInvalidRequest {
+		t.Fatalf("step4 = %v, %v, want validation error", resp, err)
+	}
+	fields := map[string]string{}
+	for _, f := range invalid.Fields {
+		fields[f.Field] = f.Code
+	}
+	for field, code := range map[string]string{
+		"md-order":          pkg.CodeFieldPattern,
+		"acs-request-id":    pkg.CodeFieldRequired,
+		"acs-session-url":   pkg.CodeFieldRequired,
+		"terminate-url":     pkg.CodeFieldRequired,
+		"one-time-password": pkg.CodeFieldPattern,
+	} {
+		if fields[field] != code {
+			t.Errorf("%s = %q, want %s", field, fields[field], code)
+		}
+	}
+}
+
+func TestServiceSubmitCardRejected(t *testing.T) {
+	tests := []struct {
+		scenario string
+		cvc      string
+		want     pkg.HackResponseStatus
+	}{
+		{mock.ScenarioUnknownPaymentSystem, "", pkg.HackResponseStatusInvalidCard},
+		{mock.ScenarioCVCRequired, "", pkg.HackResponseStatusSpecifyCVC},
+		{mock.ScenarioCVCRequired, "123", pkg.HackResponseStatusOk},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scenario, func(t *testing.T) {
+			e := newServiceEnv(t, tt.scenario)
+			step1 := e.start(t)
+			step2 := e.submitCard(t, step1.Token, tt.cvc)
+			if step2.Status != tt.want {
+				t.Errorf("status = %s, want %s", step2.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceConfirmPaymentWrongOTP(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioWrongOTP)
+	step1 := e.start(t)
+	e.submitCard(t, step1.Token, "")
+	for attempt := 1; attempt < 3; attempt++ {
+		step4 := e.confirm(t, step1.Token, "000000")
+		if step4.Status != pkg.HackResponseStatusWrongOTP {
+			t.Fatalf("attempt %d status = %s, want %s", attempt, step4.Status, pkg.HackResponseStatusWrongOTP)
+		}
+		if step4.CurrentAttempt != attempt || step4.TotalAttempts != 3 {
+			t.Errorf("attempt %d = %d of %d", attempt, step4.CurrentAttempt, step4.TotalAttempts)
+		}
+	}
+	step4 := e.confirm(t, step1.Token, "000000")
+	if step4.Status != pkg.HackResponseStatusOperationCancelled {
+		t.Errorf("last attempt status = %s, want %s", step4.Status, pkg.HackResponseStatusOperationCancelled)
+	}
+}
+
+func TestServiceConfirmPaymentOperationCancelled(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioOperationCancelled)
+	step1 := e.start(t)
+	e.submitCard(t, step1.Token, "")
+	step4, err := e.service.Step4ConfirmPayment(context.Background(), pkg.ConfirmPaymentRequest{
+		Application:     testApplication,
+		Identity:        testIdentity,
+		Token:           step1.Token,
+		OneTimePassword: "000000",
+	})
+	if !errors.Is(err, pkg.ErrWrongPasswordOperationCancelled) {
+		t.Errorf("error = %v, want %v", err, pkg.ErrWrongPasswordOperationCancelled)
+	}
+	if step4.Status != pkg.HackResponseStatusOperationCancelled {
+		t.Errorf("status = %s, want %s", step4.Status, pkg.HackResponseStatusOperationCancelled)
+	}
+}
+
+func TestServiceResendCodeExhausted(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioResendExhausted)
+	step1 := e.start(t)
+	step2 := e.submitCard(t, step1.Token, "")
+	if step2.Status != pkg.HackResponseStatusOk || step2.ResendAttemptsLeft != 0 {
+		t.Errorf("step2 = %v, want ok without resend attempts", step2)
+	}
+}
+
+func TestServiceSessionOfOtherIdentity(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioSuccess)
+	step1 := e.start(t)
+	resp, err := e.service.Step2SubmitCard(context.Background(), pkg.SubmitCardRequest{
+		Application: testApplication,
+		Identity:    "someoneelse",
+		Token:       step1.Token,
+		CardNumber:  testCardNumber,
+		Expiry:      testCardExpiry,
+		NameOnCard:  testNameOnCard,
+	})
+	if err == nil || resp.Status != pkg.HackResponseStatusAlreadyProcessed {
+		t.Errorf("step2 = %v, %v, want session error", resp, err)
+	}
+}
+
+func TestServiceKeepsACSCookies(t *testing.T) {
+	scenario, _ := mock.ScenarioByName(mock.ScenarioSuccess)
+	scenario.RequireACSCookie = true
+	e := newServiceEnvWithScenario(t, scenario)
+	step1 := e.start(t)
+	step2 := e.submitCard(t, step1.Token, "")
+	if step2.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("step2 status = %s, want %s", step2.Status, pkg.HackResponseStatusOk)
+	}
+	inspect, err := e.service.InspectSession(context.Background(), pkg.InspectSessionRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		Token:       step1.Token,
+	})
+	if err != nil || len(inspect.Cookies) != 1 || inspect.Cookies[0].Name != "JSESSIONID" {
+		t.Errorf("inspect session = %+v, %v, want JSESSIONID cookie", inspect, err)
+	}
+	step4 := e.confirm(t, step1.Token, mock.DefaultOTP)
+	if step4.Status != pkg.HackResponseStatusOk {
+		t.Errorf("step4 status = %s, want %s", step4.Status, pkg.HackResponseStatusOk)
+	}
+}
+
+// withOutcomeUrls sets return and fail url patterns of mock bank, {bank} is replaced with url of mock
+func withOutcomeUrls(returnUrls, failUrls []string) serviceEnvOption {
+	withBank := func(patterns []string, bankUrl string) []string {
+		replaced := make([]string, 0, len(patterns))
+		for _, p := range patterns {
+			replaced = append(replaced, strings.ReplaceAll(p, "{bank}", bankUrl))
+		}
+		return replaced
+	}
+	return withBankProfile(func(profile *pkg.BankProfile, bankUrl string) {
+		profile.ReturnUrls = withBank(returnUrls, bankUrl)
+		profile.FailUrls = withBank(failUrls, bankUrl)
+	})
+}
+
+func TestServicePaymentOutcome(t *testing.T) {
+	const mdOrder = "0a1b2c3d-0000-4000-8000-000000000001"
+	tests := []struct {
+		name      string
+		finalUrl  string
+		returnUrl string
+		// bank patterns, {bank} is replaced with url of mock
+		returnUrls []string
+		failUrls   []string
+		want       pkg.PaymentResult
+		errorCode  string
+	}{
+		{name: "return url of session", returnUrl: "{bank}/merchant/finish.html?shop=1", want: pkg.PaymentResultSuccess},
+		{name: "return url of bank", returnUrls: []string{"{bank}/merchant/*"}, want: pkg.PaymentResultSuccess},
+		{
+			name:       "fail url of bank",
+			finalUrl:   "/merchant/fail.html",
+			returnUrls: []string{"{bank}/merchant/finish.html"},
+			failUrls:   []string{"{bank}/merchant/fail*"},
+			want:       pkg.PaymentResultFailure,
+		},
+		{
+			name:       "error of bank on return url",
+			finalUrl:   "/merchant/finish.html?errorCode=5&errorMessage=Declined",
+			returnUrls: []string{"{bank}/merchant/finish.html"},
+			want:       pkg.PaymentResultFailure,
+			errorCode:  "5",
+		},
+		{
+			name:       "fail url within return url",
+			finalUrl:   "/merchant/fail.html",
+			returnUrls: []string{"{bank}/merchant/*"},
+			failUrls:   []string{"{bank}/merchant/fail*"},
+			want:       pkg.PaymentResultFailure,
+		},
+		{
+			name:       "return url around fail url",
+			finalUrl:   "/merchant/finish.html",
+			returnUrls: []string{"{bank}/merchant/*"},
+			failUrls:   []string{"{bank}/merchant/fail*"},
+			want:       pkg.PaymentResultSuccess,
+		},
+		{
+			// shop.invalid never resolves, page of merchant out of bank hosts is not requested
+			name:       "merchant out of bank hosts",
+			finalUrl:   "https://shop.invalid/finish.html",
+			returnUrls: []string{"https://shop.invalid/*"},
+			want:       pkg.PaymentResultSuccess,
+		},
+		{name: "no patterns", want: pkg.PaymentResultUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scenario, _ := mock.ScenarioByName(mock.ScenarioSuccess)
+			scenario.FinalUrl = tt.finalUrl
+			e := newServiceEnvWithScenario(t, scenario, withOutcomeUrls(tt.returnUrls, tt.failUrls))
+			step1, err := e.service.Step1StartHack(context.Background(), pkg.StartHackRequest{
+				Application: testApplication,
+				Identity:    testIdentity,
+				PaymentUrl:  e.paymentUrl(mdOrder),
+				ReturnUrl:   strings.ReplaceAll(tt.returnUrl, "{bank}", e.bank.URL),
+			})
+			if err != nil {
+				t.Fatalf("step1 start hack failed: %v", err)
+			}
+			e.submitCard(t, step1.Token, "")
+			step4 := e.confirm(t, step1.Token, mock.DefaultOTP)
+			if step4.Status != pkg.HackResponseStatusOk || step4.Outcome == nil {
+				t.Fatalf("step4 = %v, want ok with outcome", step4)
+			}
+			if step4.Outcome.Result != tt.want || step4.Outcome.OrderId != mdOrder || step4.Outcome.ErrorCode != tt.errorCode {
+				t.Errorf("step4 outcome = %+v, want %s of order %s with error code %q", *step4.Outcome, tt.want, mdOrder, tt.errorCode)
+			}
+		})
+	}
+}
+
+func TestServiceOrderStatus(t *testing.T) {
+	tests := []struct {
+		scenario   string
+		otp        string
+		want       pkg.OrderOutcome
+		actionCode int
+	}{
+		{mock.ScenarioSuccess, mock.DefaultOTP, pkg.OrderOutcomeDeposited, 0},
+		{mock.ScenarioTwoStage, mock.DefaultOTP, pkg.OrderOutcomeApproved, 0},
+		{mock.ScenarioOperationCancelled, "000000", pkg.OrderOutcomeDeclined, -2006},
+		{mock.ScenarioWrongOTP, "", pkg.OrderOutcomePending, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scenario, func(t *testing.T) {
+			e := newServiceEnv(t, tt.scenario)
+			step1 := e.start(t)
+			e.submitCard(t, step1.Token, "")
+			if tt.otp != "" {
+				e.confirm(t, step1.Token, tt.otp)
+			}
+			// completed session still gives md-order
+			resp, err := e.service.Step5OrderStatus(context.Background(), pkg.OrderStatusRequest{
+				Application: testApplication,
+				Identity:    testIdentity,
+				Token:       step1.Token,
+			})
+			if err != nil || resp.Status != pkg.HackResponseStatusOk {
+				t.Fatalf("step5 = %v, %v", resp, err)
+			}
+			if resp.Outcome != tt.want || resp.ActionCode != tt.actionCode || resp.MDOrder != step1.MDOrder {
+				t.Errorf("step5 = %v, want %s with action code %d", resp, tt.want, tt.actionCode)
+			}
+			if resp.Amount != 1000 || resp.Currency != "934" {
+				t.Errorf("step5 amount = %d %s, want 1000 934", resp.Amount, resp.Currency)
+			}
+		})
+	}
+}
+
+func TestServiceOrderStatusUnknownOrder(t *testing.T) {
+	e := newServiceEnv(t, mock.ScenarioSuccess)
+	resp, err := e.service.Step5OrderStatus(context.Background(), pkg.OrderStatusRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		MDOrder:     "0a1b2c3d-0000-4000-8000-000000000009",
+	})
+	var rejected *pkg.BankRejectedError
+	if !errors.As(err, &rejected) || rejected.Code != 6 {
+		t.Errorf("error = %v, want bank rejected with code 6", err)
+	}
+	if resp.Status != pkg.HackResponseStatusOtherError || resp.Outcome != "" {
+		t.Errorf("step5 = %v, want %s without outcome", resp, pkg.HackResponseStatusOtherError)
+	}
+}
+
+func TestStatusFromError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want pkg.HackResponseStatus
+	}{
+		{nil, pkg.HackResponseStatusOk},
+		{&pkg.NetworkError{Url: "http://bank", Err: errors.New("refused")}, pkg.HackResponseStatusNetworkError},
+		{&pkg.UnexpectedStatusError{Url: "http://bank", Code: 502}, pkg.HackResponseStatusOtherError},
+		{&pkg.ParseError{Page: pkg.PageACS, Field: "PaRes"}, pkg.HackResponseStatusOtherError},
+		{&pkg.SessionExpiredError{MDOrder: "1"}, pkg.HackResponseStatusAlreadyProcessed},
+		{&pkg.BankRejectedError{Code: 1, Message: "Не указан код CVC2/CVV2"}, pkg.HackResponseStatusSpecifyCVC},
+		{&pkg.BankRejectedError{Code: 1, Message: "Отказ: недостаточно средств"}, pkg.HackResponseStatusInsufficientFunds},
+		{&pkg.BankRejectedError{Code: 1, Message: "Код ошибки 5"}, pkg.HackResponseStatusOtherError},
+		{&pkg.BankRejectedError{Code: 1, Message: "whatever", Reason: classify.ReasonCardBlocked}, pkg.HackResponseStatusCardBlocked},
+		{pkg.ErrWrongPasswordOperationCancelled, pkg.HackResponseStatusOperationCancelled},
+		{pkg.ErrPaymentCompleted, pkg.HackResponseStatusAlreadyProcessed},
+		{&pkg.OperationError{Step: pkg.StepStartHack, Part: pkg.PartBank, Err: pkg.ErrUnknownBank}, pkg.HackResponseStatusUnknownBank},
+		{&pkg.OperationError{Step: pkg.StepSubmitCard, Part: pkg.PartBank, Err: pkg.ErrSessionRequired}, pkg.HackResponseStatusInvalidRequest},
+	}
+	for _, tt := range tests {
+		if got := pkg.StatusFromError(tt.err); got != tt.want {
+			t.Errorf("StatusFromError(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestServiceTracesSteps(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	e := newServiceEnv(t, mock.ScenarioSuccess, withServiceOptions(
+		pkg.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))))
+	_, _ = e.service.Step1StartHack(context.Background(), pkg.StartHackRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		PaymentUrl:  e.paymentUrl("0a1b2c3d-0000-4000-8000-000000000006"),
+	})
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("spans = %d, want 2", len(spans))
+	}
+	upstream, step := spans[0], spans[1]
+	if step.Name() != "Step1StartHack" || upstream.Name() != string(pkg.PartSessionStatus) {
+		t.Errorf("span names = %s, %s", step.Name(), upstream.Name())
+	}
+	if upstream.Parent().SpanID() != step.SpanContext().SpanID() {
+		t.Error("session status span is not child of step span")
+	}
+}
+
+func TestServiceLinksStepsOfPayment(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	e := newServiceEnv(t, mock.ScenarioSuccess, withServiceOptions(
+		pkg.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))))
+	step1 := e.start(t)
+	e.submitCard(t, step1.Token, "")
+	e.confirm(t, step1.Token, mock.DefaultOTP)
+
+	steps := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		steps[span.Name()] = span
+	}
+	start := steps["Step1StartHack"]
+	if start == nil {
+		t.Fatal("start hack span is not recorded")
+	}
+	for _, name := range []string{"Step2SubmitCard", "Step4ConfirmPayment"} {
+		span := steps[name]
+		if span == nil {
+			t.Errorf("%s span is not recorded", name)
+			continue
+		}
+		links := span.Links()
+		if len(links) != 1 || links[0].SpanContext.TraceID() != start.SpanContext().TraceID() ||
+			links[0].SpanContext.SpanID() != start.SpanContext().SpanID() {
+			t.Errorf("%s links = %v, want link to start hack span", name, links)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SessionStep is the last workflow step successfully completed within a payment session
+type SessionStep string
+
+const (
+	SessionStepStarted       SessionStep = "started"
+	SessionStepCardSubmitted SessionStep = "card-submitted"
+	// payment was confirmed or cancelled, session is kept only to look up order status
+	SessionStepCompleted SessionStep = "completed"
+)
+
+// CompletedSessionTTL is how long session is kept after payment is completed, for order status lookups
+const CompletedSessionTTL = 30 * time.Minute
+
+// Session keeps everything bpchack learned about a single payment between workflow steps,
+// so clients only have to hold an opaque token instead of raw bank urls and ids
+type Session struct {
+	Token       string `json:"token"`
+	Application string `json:"application"`
+	Identity    string `json:"identity"`
+	// name of bank profile payment belongs to
+	Bank          string `json:"bank"`
+	MDOrder       string `json:"md-order"`
+	ACSRequestId  string `json:"acs-request-id,omitempty"`
+	ACSSessionUrl string `json:"acs-session-url,omitempty"`
+	TerminateUrl  string `json:"terminate-url,omitempty"`
+	// merchant urls given to register.do, to tell outcome of payment by final url
+	ReturnUrl string `json:"return-url,omitempty"`
+	FailUrl   string `json:"fail-url,omitempty"`
+	// cookies set by MPI and ACS, some ACS deployments reject password without their session cookie
+	Cookies   []SessionCookie `json:"cookies,omitempty"`
+	Step      SessionStep     `json:"step"`
+	CreatedAt time.Time       `json:"created-at"`
+	UpdatedAt time.Time       `json:"updated-at"`
+	ExpiresAt time.Time       `json:"expires-at"`
+	// span of start hack step, spans of later steps link to it
+	TraceId string `json:"trace-id,omitempty"`
+	SpanId  string `json:"span-id,omitempty"`
+}
+
+func (s *Session) IsExpired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+// SessionStore persists payment sessions between workflow steps
+type SessionStore interface {
+	// Save creates or replaces session with the same token
+	Save(ctx context.Context, session Session) error
+	// Load returns ErrSessionNotFound if session does not exist or has expired
+	Load(ctx context.Context, token string) (Session, error)
+	Delete(ctx context.Context, token string) error
+	// Close releases resources held by store
+	Close() error
+}
+
+var ErrSessionNotFound = errors.New("session not found or expired")
+
+// ErrPaymentCompleted means payment of session was already confirmed or cancelled
+var ErrPaymentCompleted = errors.New("payment of session is already completed")
+
+func newSessionToken() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, "error generating session token")
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// purge of expired sessions scans all of them, so it runs at most once per memoryPurgeInterval
+const memoryPurgeInterval = time.Minute
+
+type memorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]Session
+	lastPurge time.Time
+}
+
+func (m *memorySessionStore) Save(_ context.Context, session Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.purgeExpired(time.Now())
+	m.sessions[session.Token] = session
+	return nil
+}
+
+// purgeExpired lazily drops expired sessions, nobody will ask for them anymore, m.mu must be held
+func (m *memorySessionStore) purgeExpired(now time.Time) {
+	if now.Sub(m.lastPurge) < memoryPurgeInterval {
+		return
+	}
+	for token, existing := range m.sessions {
+		if existing.IsExpired(now) {
+			delete(m.sessions, token)
+		}
+	}
+	m.lastPurge = now
+}
+
+func (m *memorySessionStore) Load(_ context.Context, token string) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[token]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	if session.IsExpired(time.Now()) {
+		delete(m.sessions, token)
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (m *memorySessionStore) Delete(_ context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, token)
+	return nil
+}
+
+func (m *memorySessionStore) Close() error {
+	return nil
+}
+
+// NewMemorySessionStore returns SessionStore keeping sessions in process memory,
+// sessions are lost on restart
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{
+		sessions: make(map[string]Session),
+	}
+}
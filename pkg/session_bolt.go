@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltSessionsBucket = []byte("sessions")
+
+// purge of expired sessions requires a full scan, so it runs at most once per boltPurgeInterval
+const boltPurgeInterval = time.Minute
+
+type boltSessionStore struct {
+	db *bolt.DB
+
+	mu        sync.Mutex
+	lastPurge time.Time
+}
+
+func (b *boltSessionStore) Save(_ context.Context, session Session) error {
+	raw, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrap(err, "error encoding session")
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionsBucket).Put([]byte(session.Token), raw)
+	})
+	if err != nil {
+		return errors.Wrap(err, "error saving session")
+	}
+	b.purgeExpired()
+	return nil
+}
+
+func (b *boltSessionStore) Load(_ context.Context, token string) (session Session, err error) {
+	var raw []byte
+	err = b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltSessionsBucket).Get([]byte(token))
+		if value != nil {
+			// value is only valid during transaction
+			raw = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		err = errors.Wrap(err, "error loading session")
+		return
+	}
+	if raw == nil {
+		err = ErrSessionNotFound
+		return
+	}
+	err = json.Unmarshal(raw, &session)
+	if err != nil {
+		err = errors.Wrap(err, "error decoding session")
+		return
+	}
+	if session.IsExpired(time.Now()) {
+		session = Session{}
+		err = ErrSessionNotFound
+	}
+	return
+}
+
+func (b *boltSessionStore) Delete(_ context.Context, token string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionsBucket).Delete([]byte(token))
+	})
+	if err != nil {
+		return errors.Wrap(err, "error deleting session")
+	}
+	return nil
+}
+
+func (b *boltSessionStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *boltSessionStore) purgeExpired() {
+	b.mu.Lock()
+	now := time.Now()
+	if now.Sub(b.lastPurge) < boltPurgeInterval {
+		b.mu.Unlock()
+		return
+	}
+	b.lastPurge = now
+	b.mu.Unlock()
+
+	purged := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSessionsBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var session Session
+			if err := json.Unmarshal(v, &session); err != nil || session.IsExpired(now) {
+				if err = c.Delete(); err != nil {
+					return err
+				}
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("error purging expired sessions")
+		return
+	}
+	if purged > 0 {
+		log.WithField("purged", purged).Debug("expired sessions purged")
+	}
+}
+
+// NewBoltSessionStore returns SessionStore keeping sessions in embedded bolt database file at path,
+// so payments in progress survive restarts
+func NewBoltSessionStore(path string) (SessionStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening session database")
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, errCreate := tx.CreateBucketIfNotExists(boltSessionsBucket)
+		return errCreate
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "error creating sessions bucket")
+	}
+	store := &boltSessionStore{db: db}
+	store.purgeExpired()
+	return store, nil
+}
@@ -0,0 +1,117 @@
+package pkg_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"ykjam/bpchack/pkg"
+)
+
+func openBoltStore(t *testing.T, path string) pkg.SessionStore {
+	t.Helper()
+	store, err := pkg.NewBoltSessionStore(path)
+	if err != nil {
+		t.Fatalf("error opening bolt store: %v", err)
+	}
+	return store
+}
+
+func testSession(token string, expiresAt time.Time) pkg.Session {
+	now := time.Now().UTC().Truncate(time.Second)
+	return pkg.Session{
+		Token:        token,
+		Application:  testApplication,
+		Identity:     testIdentity,
+		Bank:         "mock",
+		MDOrder:      "0a1b2c3d-0000-4000-8000-000000000001",
+		ACSRequestId: "request-1",
+		Cookies:      []pkg.SessionCookie{{Name: "JSESSIONID", Value: "cookie", Path: "/acs"}},
+		Step:         pkg.SessionStepCardSubmitted,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		ExpiresAt:    expiresAt.UTC().Truncate(time.Second),
+	}
+}
+
+func TestBoltSessionStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	ctx := context.Background()
+	saved := testSession("0123456789abcdef0123456789abcdef", time.Now().Add(time.Hour))
+	store := openBoltStore(t, path)
+	if err := store.Save(ctx, saved); err != nil {
+		t.Fatalf("error saving session: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("error closing store: %v", err)
+	}
+
+	store = openBoltStore(t, path)
+	defer store.Close()
+	loaded, err := store.Load(ctx, saved.Token)
+	if err != nil {
+		t.Fatalf("error loading session after reopen: %v", err)
+	}
+	if loaded.MDOrder != saved.MDOrder || loaded.Step != saved.Step || loaded.ACSRequestId != saved.ACSRequestId ||
+		!loaded.ExpiresAt.Equal(saved.ExpiresAt) || len(loaded.Cookies) != 1 || loaded.Cookies[0].Value != "cookie" {
+		t.Errorf("loaded session = %+v, want %+v", loaded, saved)
+	}
+}
+
+func TestBoltSessionStoreNotFound(t *testing.T) {
+	store := openBoltStore(t, filepath.Join(t.TempDir(), "sessions.db"))
+	defer store.Close()
+	ctx := context.Background()
+	if _, err := store.Load(ctx, "ffffffffffffffffffffffffffffffff"); !errors.Is(err, pkg.ErrSessionNotFound) {
+		t.Errorf("load of unknown token error = %v, want %v", err, pkg.ErrSessionNotFound)
+	}
+	session := testSession("0123456789abcdef0123456789abcdef", time.Now().Add(time.Hour))
+	if err := store.Save(ctx, session); err != nil {
+		t.Fatalf("error saving session: %v", err)
+	}
+	if err := store.Delete(ctx, session.Token); err != nil {
+		t.Fatalf("error deleting session: %v", err)
+	}
+	if _, err := store.Load(ctx, session.Token); !errors.Is(err, pkg.ErrSessionNotFound) {
+		t.Errorf("load of deleted session error = %v, want %v", err, pkg.ErrSessionNotFound)
+	}
+}
+
+func TestBoltSessionStorePurgesExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	ctx := context.Background()
+	expired := testSession("00000000000000000000000000000001", time.Now().Add(-time.Minute))
+	alive := testSession("00000000000000000000000000000002", time.Now().Add(time.Hour))
+	store := openBoltStore(t, path)
+	for _, s := range []pkg.Session{expired, alive} {
+		if err := store.Save(ctx, s); err != nil {
+			t.Fatalf("error saving session: %v", err)
+		}
+	}
+	if _, err := store.Load(ctx, expired.Token); !errors.Is(err, pkg.ErrSessionNotFound) {
+		t.Errorf("load of expired session error = %v, want %v", err, pkg.ErrSessionNotFound)
+	}
+	_ = store.Close()
+
+	// expired sessions are purged when store is opened
+	_ = openBoltStore(t, path).Close()
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer db.Close()
+	_ = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("sessions"))
+		if b.Get([]byte(expired.Token)) != nil {
+			t.Error("expired session is still stored")
+		}
+		if b.Get([]byte(alive.Token)) == nil {
+			t.Error("session which has not expired is purged")
+		}
+		return nil
+	})
+}
@@ -2,18 +2,34 @@ package pkg
 
 type StartHackRequest struct {
 	// application trying to use bpc hack, for information purpose only
-	Application string `json:"app"`
+	Application string `json:"application"`
 	// to identify each user's request one from another
-	Identity string `json:"id"`
+	Identity string `json:"identity"`
 	// url you received to redirect user to (during https://{crappy_bpc_server}/register.do request)
-	PaymentUrl string `json:"url"`
+	PaymentUrl string `json:"payment-url"`
+	// returnUrl and failUrl given to register.do, optional, they tell outcome of payment better than bank patterns
+	ReturnUrl string `json:"return-url,omitempty"`
+	FailUrl   string `json:"fail-url,omitempty"`
+}
+
+// fields returns values of request by json name, for validation
+func (r StartHackRequest) fields() map[string]string {
+	return map[string]string{
+		"application": r.Application,
+		"identity":    r.Identity,
+		"payment-url": r.PaymentUrl,
+		"return-url":  r.ReturnUrl,
+		"fail-url":    r.FailUrl,
+	}
 }
 
 type StartHackResponse struct {
-	Status        HackResponseStatus `json:"status"`
-	MDOrder       string             `json:"md-order,omitempty"`
-	RemainingTime int64              `json:"remaining-time,omitempty"`
-	ExpirationTs  int64              `json:"expiration-ts,omitempty"`
-	IsCVCRequired bool               `json:"is-cvc-required,omitempty"`
-	AmountInfo    string             `json:"amount-info,omitempty"`
+	Status HackResponseStatus `json:"status"`
+	// opaque session token, pass it to following steps instead of md-order, acs and terminate urls
+	Token         string `json:"token,omitempty"`
+	MDOrder       string `json:"md-order,omitempty"`
+	RemainingTime int64  `json:"remaining-time,omitempty"`
+	ExpirationTs  int64  `json:"expiration-ts,omitempty"`
+	IsCVCRequired bool   `json:"is-cvc-required,omitempty"`
+	AmountInfo    string `json:"amount-info,omitempty"`
 }
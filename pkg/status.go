@@ -11,4 +11,21 @@ const (
 	HackResponseStatusOtherError         HackResponseStatus = "other-error"
 	HackResponseStatusSpecifyCVC         HackResponseStatus = "specify-cvc"
 	HackResponseStatusInvalidCard        HackResponseStatus = "invalid-card"
+	HackResponseStatusInsufficientFunds  HackResponseStatus = "insufficient-funds"
+	HackResponseStatusCardBlocked        HackResponseStatus = "card-blocked"
+	HackResponseStatusCardExpired        HackResponseStatus = "card-expired"
+	// card is not enrolled in 3-D Secure
+	HackResponseStatusNotEnrolled   HackResponseStatus = "not-enrolled"
+	HackResponseStatusLimitExceeded HackResponseStatus = "limit-exceeded"
+	HackResponseStatusUnknownBank   HackResponseStatus = "unknown-bank"
+	// payment flow tried to reach host or address not approved for the bank
+	HackResponseStatusRejectedDestination HackResponseStatus = "rejected-destination"
+	// bank MPI keeps failing, requests to it are suspended for a while
+	HackResponseStatusBankUnavailable HackResponseStatus = "bank-unavailable"
+	// request did not pass validation
+	HackResponseStatusInvalidRequest HackResponseStatus = "invalid-request"
+	// client application is not authenticated or not allowed, never returned by service
+	HackResponseStatusUnauthorized HackResponseStatus = "unauthorized"
+	// client exceeded rate limit of endpoint, never returned by service
+	HackResponseStatusRateLimited HackResponseStatus = "rate-limited"
 )
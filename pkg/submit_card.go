@@ -4,9 +4,11 @@ import "fmt"
 
 type SubmitCardRequest struct {
 	// application trying to use bpc hack, for information purpose only
-	Application string `json:"app"`
+	Application string `json:"application"`
 	// to identify each user's request one from another
-	Identity   string `json:"id"`
+	Identity string `json:"identity"`
+	// session token received in start hack, when given MDOrder is taken from session
+	Token      string `json:"token,omitempty"`
 	MDOrder    string `json:"md-order"`
 	CardNumber string `json:"card-number"`
 	Expiry     string `json:"card-expiry"`
@@ -14,10 +16,25 @@ type SubmitCardRequest struct {
 	CVCCode    string `json:"card-cvc,omitempty"`
 }
 
+// fields returns values of request by json name, for validation
+func (r SubmitCardRequest) fields() map[string]string {
+	return map[string]string{
+		"application":  r.Application,
+		"identity":     r.Identity,
+		"token":        r.Token,
+		"md-order":     r.MDOrder,
+		"card-number":  r.CardNumber,
+		"card-expiry":  r.Expiry,
+		"name-on-card": r.NameOnCard,
+		"card-cvc":     r.CVCCode,
+	}
+}
+
 type SubmitCardResponse struct {
-	Status        HackResponseStatus `json:"status"`
-	ACSRequestId  string             `json:"acs-request-id,omitempty"`
-	ACSSessionUrl string             `json:"acs-session-url,omitempty"`
+	Status HackResponseStatus `json:"status"`
+	// acs parameters and terminate url are given only to requests without token
+	ACSRequestId  string `json:"acs-request-id,omitempty"`
+	ACSSessionUrl string `json:"acs-session-url,omitempty"`
 	// number shown in acs form
 	ThreeDSecureNumber string `json:"three-d-secure-number,omitempty"`
 	ResendAttemptsLeft int    `json:"resend-attempts-left,omitempty"`
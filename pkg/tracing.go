@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "ykjam/bpchack/pkg"
+
+// startStepSpan starts span of workflow step, it is ended by endStepSpan
+func (s *service) startStepSpan(ctx context.Context, name, application, identity string, links ...trace.Link) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("bpchack.application", application),
+		attribute.String("bpchack.identity", identity),
+	), trace.WithLinks(links...))
+}
+
+// paymentLinks returns link to span of start hack step kept in session of token,
+// steps of payment are separate requests, so each may continue its own trace of calling application
+func (s *service) paymentLinks(ctx context.Context, token, application, identity string) []trace.Link {
+	if token == "" {
+		return nil
+	}
+	session, err := s.loadSession(ctx, token, application, identity)
+	if err != nil {
+		return nil
+	}
+	traceId, errTrace := trace.TraceIDFromHex(session.TraceId)
+	spanId, errSpan := trace.SpanIDFromHex(session.SpanId)
+	if errTrace != nil || errSpan != nil {
+		return nil
+	}
+	return []trace.Link{{SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})}}
+}
+
+func endStepSpan(span trace.Span, bank *BankProfile, status HackResponseStatus, err error) {
+	span.SetAttributes(
+		attribute.String("bpchack.bank", bank.label()),
+		attribute.String("bpchack.status", string(status)),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startUpstreamSpan starts span of sub-request to bank, it is ended by endUpstreamSpan
+func (s *service) startUpstreamSpan(ctx context.Context, part, host string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, part,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", http.MethodPost),
+			attribute.String("net.peer.name", host),
+		))
+}
+
+func endUpstreamSpan(span trace.Span, res *http.Response, err error) {
+	if res != nil {
+		span.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
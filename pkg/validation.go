@@ -0,0 +1,239 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"ykjam/bpchack/pkg/card"
+)
+
+// patterns of fields shared by every step, also used by web before authentication
+const (
+	ApplicationPattern = `[a-zA-Z0-9]{3,16}`
+	IdentityPattern    = `[a-zA-Z0-9]{3,64}`
+)
+
+// machine-readable codes of FieldError, card fields have codes of card package besides these
+const (
+	CodeFieldRequired   = "required"
+	CodeFieldTooShort   = "too-short"
+	CodeFieldTooLong    = "too-long"
+	CodeFieldPattern    = "pattern-mismatch"
+	CodeFieldInvalidUrl = "invalid-url"
+	CodeFieldUrlScheme  = "url-scheme-not-allowed"
+)
+
+// FieldRule declares valid values of request field, empty value passes unless field is required
+type FieldRule struct {
+	Required bool
+	// field is required when the other one is empty, e.g. md-order of requests without token
+	RequiredWithout string
+	MinLength       int
+	MaxLength       int
+	// regular expression whole value must match
+	Pattern string
+	// value must be absolute url with one of schemes
+	UrlSchemes []string
+}
+
+// FieldRules are rules of request by json name of field
+type FieldRules map[string]FieldRule
+
+// ValidationRules are rules of requests by step
+type ValidationRules map[Step]FieldRules
+
+// FieldError tells why value of field is not valid
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of request which is not valid
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		messages[i] = fmt.Sprintf("%s: %s", f.Field, f.Message)
+	}
+	return "request is not valid: " + strings.Join(messages, ", ")
+}
+
+// DefaultValidationRules are rules every bank starts with
+func DefaultValidationRules() ValidationRules {
+	application := FieldRule{Required: true, Pattern: ApplicationPattern}
+	identity := FieldRule{Required: true, Pattern: IdentityPattern}
+	token := FieldRule{Pattern: `[0-9a-f]{32}`}
+	mdOrder := FieldRule{
+		RequiredWithout: "token",
+		Pattern:         `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+	}
+	acsRequestId := FieldRule{RequiredWithout: "token", Pattern: `[A-Za-z0-9._:-]{1,128}`}
+	urlSchemes := []string{"https", "http"}
+	acsSessionUrl := FieldRule{RequiredWithout: "token", MaxLength: 2048, UrlSchemes: urlSchemes}
+	return ValidationRules{
+		StepStartHack: {
+			"application": application,
+			"identity":    identity,
+			"payment-url": {Required: true, MaxLength: 2048, UrlSchemes: urlSchemes},
+			"return-url":  {MaxLength: 2048, UrlSchemes: urlSchemes},
+			"fail-url":    {MaxLength: 2048, UrlSchemes: urlSchemes},
+		},
+		StepSubmitCard: {
+			"application": application,
+			"identity":    identity,
+			"token":       token,
+			"md-order":    mdOrder,
+			// card number, expiry and cvc are checked by validateCard
+			"name-on-card": {Required: true, MinLength: 4, MaxLength: 32},
+		},
+		StepResendCode: {
+			"application":     application,
+			"identity":        identity,
+			"token":           token,
+			"acs-request-id":  acsRequestId,
+			"acs-session-url": acsSessionUrl,
+		},
+		StepConfirmPayment: {
+			"application":       application,
+			"identity":          identity,
+			"token":             token,
+			"md-order":          mdOrder,
+			"acs-request-id":    acsRequestId,
+			"acs-session-url":   acsSessionUrl,
+			"one-time-password": {Required: true, Pattern: `[0-9]{4,8}`},
+			"terminate-url":     {RequiredWithout: "token", MaxLength: 2048, UrlSchemes: urlSchemes},
+		},
+		StepOrderStatus: {
+			"application": application,
+			"identity":    identity,
+			"token":       token,
+			"md-order":    mdOrder,
+		},
+	}
+}
+
+// override returns copy of rules with fields of overrides replacing the same fields of rules
+func (r ValidationRules) override(overrides ValidationRules) ValidationRules {
+	merged := make(ValidationRules, len(r))
+	for step, fields := range r {
+		merged[step] = make(FieldRules, len(fields))
+		for name, rule := range fields {
+			merged[step][name] = rule
+		}
+	}
+	for step, fields := range overrides {
+		if merged[step] == nil {
+			merged[step] = make(FieldRules, len(fields))
+		}
+		for name, rule := range fields {
+			merged[step][name] = rule
+		}
+	}
+	return merged
+}
+
+type compiledRule struct {
+	FieldRule
+	pattern *regexp.Regexp
+}
+
+type validator map[Step]map[string]compiledRule
+
+func newValidator(rules ValidationRules) (validator, error) {
+	v := make(validator, len(rules))
+	for step, fields := range rules {
+		v[step] = make(map[string]compiledRule, len(fields))
+		for name, rule := range fields {
+			c := compiledRule{FieldRule: rule}
+			if rule.Pattern != "" {
+				var err error
+				// rule matches whole value
+				c.pattern, err = regexp.Compile(`^(?:` + rule.Pattern + `)$`)
+				if err != nil {
+					return nil, errors.Wrapf(err, "error in pattern of %s of %s", name, step)
+				}
+			}
+			v[step][name] = c
+		}
+	}
+	return v, nil
+}
+
+// CheckValidationRules reports rules which can not be used, e.g. with patterns not compiling
+func CheckValidationRules(rules ValidationRules) error {
+	_, err := newValidator(rules)
+	return err
+}
+
+// check validates values of request fields of step, it returns *ValidationError listing fields not valid
+func (v validator) check(step Step, values map[string]string) error {
+	var fields []FieldError
+	for name, rule := range v[step] {
+		if code, message := rule.check(values[name], values); code != "" {
+			fields = append(fields, FieldError{Field: name, Code: code, Message: message})
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Field < fields[j].Field
+	})
+	return &ValidationError{Fields: fields}
+}
+
+func (r compiledRule) check(value string, values map[string]string) (code, message string) {
+	if value == "" {
+		if r.Required || (r.RequiredWithout != "" && values[r.RequiredWithout] == "") {
+			return CodeFieldRequired, "value is required"
+		}
+		return "", ""
+	}
+	if r.MinLength > 0 && len(value) < r.MinLength {
+		return CodeFieldTooShort, fmt.Sprintf("value must be at least %d characters", r.MinLength)
+	}
+	if r.MaxLength > 0 && len(value) > r.MaxLength {
+		return CodeFieldTooLong, fmt.Sprintf("value must be at most %d characters", r.MaxLength)
+	}
+	if r.pattern != nil && !r.pattern.MatchString(value) {
+		return CodeFieldPattern, "value does not match pattern " + r.Pattern
+	}
+	if len(r.UrlSchemes) > 0 {
+		u, err := url.Parse(value)
+		if err != nil || u.Host == "" {
+			return CodeFieldInvalidUrl, "value is not an absolute url"
+		}
+		allowed := false
+		for _, scheme := range r.UrlSchemes {
+			allowed = allowed || strings.EqualFold(u.Scheme, scheme)
+		}
+		if !allowed {
+			return CodeFieldUrlScheme, fmt.Sprintf("url scheme must be one of %s", strings.Join(r.UrlSchemes, ", "))
+		}
+	}
+	return "", ""
+}
+
+// validateCard checks card details beyond their format and normalizes expiry to YYYYMM expected by bank
+func validateCard(req *SubmitCardRequest, now time.Time) error {
+	details, err := card.Validate(req.CardNumber, req.Expiry, req.NameOnCard, req.CVCCode, now)
+	if err != nil {
+		var cardErr *card.ValidationError
+		if errors.As(err, &cardErr) {
+			return &ValidationError{Fields: []FieldError{{Field: cardErr.Field, Code: cardErr.Code, Message: cardErr.Message}}}
+		}
+		return err
+	}
+	req.Expiry = details.Expiry
+	return nil
+}
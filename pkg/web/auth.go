@@ -0,0 +1,216 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+
+	"ykjam/bpchack/pkg"
+)
+
+// headers of authenticated requests, see README for signature
+const (
+	HeaderAPIKey      = "X-API-Key"
+	HeaderApplication = "X-Application"
+	HeaderTimestamp   = "X-Timestamp"
+	HeaderSignature   = "X-Signature"
+)
+
+// MaxClockSkew is the most timestamp of signed request may differ from server time,
+// clients can learn server time from /api/epoch
+const MaxClockSkew = 5 * time.Minute
+
+// maxSignedBodySize limits body read for signature check
+const maxSignedBodySize = 1 << 20
+
+// ApplicationCredentials allow application to call workflow endpoints,
+// with api key, with HMAC-SHA256 signature made with secret, or with both
+type ApplicationCredentials struct {
+	Application string
+	APIKey      string
+	HMACSecret  string
+	// disabled application is refused with 403
+	Disabled bool
+}
+
+type Authenticator interface {
+	// Middleware refuses requests without valid credentials,
+	// application authenticated is kept in context of request
+	Middleware(next http.Handler) http.Handler
+}
+
+type authenticator struct {
+	applications map[string]ApplicationCredentials
+	now          func() time.Time
+
+	mu sync.Mutex
+	// signatures used, until they expire
+	seen       map[string]time.Time
+	lastPruned time.Time
+}
+
+// NewAuthenticator creates authenticator of applications,
+// every request is let through if no applications are given
+func NewAuthenticator(applications []ApplicationCredentials) Authenticator {
+	a := &authenticator{
+		applications: make(map[string]ApplicationCredentials, len(applications)),
+		now:          time.Now,
+		seen:         make(map[string]time.Time),
+	}
+	for _, app := range applications {
+		a.applications[app.Application] = app
+	}
+	return a
+}
+
+type applicationKey struct{}
+
+func withApplication(ctx context.Context, application string) context.Context {
+	return context.WithValue(ctx, applicationKey{}, application)
+}
+
+func applicationFromContext(ctx context.Context) string {
+	application, _ := ctx.Value(applicationKey{}).(string)
+	return application
+}
+
+// authorizedFor checks that request is made on behalf of authenticated application, if any,
+// and responds with 403 otherwise
+func authorizedFor(ctx context.Context, clog *log.Entry, w http.ResponseWriter, application string) bool {
+	authenticated := applicationFromContext(ctx)
+	if authenticated == "" || authenticated == application {
+		return true
+	}
+	clog.WithField("authenticated", authenticated).Warn("request on behalf of other application")
+	errorResponse(ctx, clog, w, http.StatusForbidden, ErrorResponse{
+		Status:  pkg.HackResponseStatusUnauthorized,
+		Code:    CodeApplicationMismatch,
+		Message: "application does not match credentials",
+	})
+	return false
+}
+
+func (a *authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(a.applications) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := requestContext(w, r)
+		clog := log.FromContext(ctx).WithFields(log.Fields{
+			"remote-addr": GetRemoteAddress(r),
+			"uri":         r.RequestURI,
+		})
+		var app ApplicationCredentials
+		var code, message string
+		var ok bool
+		if key := r.Header.Get(HeaderAPIKey); key != "" {
+			app, ok = a.byAPIKey(key)
+			code, message = CodeUnauthenticated, "api key is not valid"
+		} else if r.Header.Get(HeaderSignature) != "" {
+			app, code, message, ok = a.bySignature(r)
+		} else {
+			code, message = CodeUnauthenticated, "credentials are required"
+		}
+		if !ok {
+			clog.WithField("code", code).Warn("request is not authenticated")
+			errorResponse(ctx, clog, w, http.StatusUnauthorized, ErrorResponse{
+				Status:  pkg.HackResponseStatusUnauthorized,
+				Code:    code,
+				Message: message,
+			})
+			return
+		}
+		if app.Disabled {
+			clog.WithField("application", app.Application).Warn("application is disabled")
+			errorResponse(ctx, clog, w, http.StatusForbidden, ErrorResponse{
+				Status:  pkg.HackResponseStatusUnauthorized,
+				Code:    CodeApplicationDisabled,
+				Message: "application is disabled",
+			})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withApplication(ctx, app.Application)))
+	})
+}
+
+func (a *authenticator) byAPIKey(key string) (app ApplicationCredentials, ok bool) {
+	// every key is compared, so time taken does not tell which one matched partially
+	for _, candidate := range a.applications {
+		if candidate.APIKey != "" && subtle.ConstantTimeCompare([]byte(candidate.APIKey), []byte(key)) == 1 {
+			app, ok = candidate, true
+		}
+	}
+	return
+}
+
+// Signature returns hex encoded HMAC-SHA256 of timestamp, method, request uri and sha256 of body,
+// each on its own line
+func Signature(secret string, timestamp int64, method, requestURI string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d\n%s\n%s\n%s", timestamp, method, requestURI, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *authenticator) bySignature(r *http.Request) (app ApplicationCredentials, code, message string, ok bool) {
+	app, known := a.applications[r.Header.Get(HeaderApplication)]
+	if !known || app.HMACSecret == "" {
+		return app, CodeUnauthenticated, "application is not known", false
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return app, CodeInvalidSignature, "timestamp is not valid", false
+	}
+	now := a.now()
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-MaxClockSkew)) || signedAt.After(now.Add(MaxClockSkew)) {
+		return app, CodeRequestExpired, "timestamp is too far from server time, see /api/epoch", false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize))
+	if err != nil {
+		return app, CodeMalformedRequest, "error reading request body", false
+	}
+	// handlers read body again
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	expected := Signature(app.HMACSecret, timestamp, r.Method, r.URL.RequestURI(), body)
+	signature := r.Header.Get(HeaderSignature)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return app, CodeInvalidSignature, "signature is not valid", false
+	}
+	if !a.firstUse(app.Application+":"+signature, signedAt.Add(MaxClockSkew)) {
+		return app, CodeReplayedRequest, "request was already used", false
+	}
+	return app, "", "", true
+}
+
+// firstUse remembers signature until it expires and reports whether it was seen for the first time
+func (a *authenticator) firstUse(signature string, expires time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if now.Sub(a.lastPruned) > time.Minute {
+		for s, e := range a.seen {
+			if e.Before(now) {
+				delete(a.seen, s)
+			}
+		}
+		a.lastPruned = now
+	}
+	if _, ok := a.seen[signature]; ok {
+		return false
+	}
+	a.seen[signature] = expires
+	return true
+}
@@ -0,0 +1,159 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+
+	"ykjam/bpchack/pkg"
+)
+
+// machine-readable error codes of ErrorResponse
+const (
+	CodeMethodNotAllowed    = "method-not-allowed"
+	CodeMalformedRequest    = "malformed-request"
+	CodeInvalidApplication  = "invalid-application-or-identity"
+	CodeSessionNotFound     = "session-not-found"
+	CodePaymentCompleted    = "payment-completed"
+	CodeSessionRequired     = "session-required"
+	CodeUnknownBank         = "unknown-bank"
+	CodeDestinationRejected = "destination-rejected"
+	CodeTimeout             = "timeout"
+	CodeBankUnreachable     = "bank-unreachable"
+	CodeBankHTTPStatus      = "bank-http-status"
+	CodeBankResponse        = "bank-response-unreadable"
+	CodeBankUnavailable     = "bank-unavailable"
+	CodeStepFailed          = "step-failed"
+	CodeUnauthenticated     = "unauthenticated"
+	CodeInvalidSignature    = "invalid-signature"
+	CodeRequestExpired      = "request-expired"
+	CodeReplayedRequest     = "replayed-request"
+	CodeApplicationDisabled = "application-disabled"
+	CodeApplicationMismatch = "application-mismatch"
+	CodeRateLimited         = "rate-limited"
+)
+
+// messages of failed steps by error code, errors themselves may carry urls of bank hosts
+// and are only logged along with request id
+var codeMessages = map[string]string{
+	CodeSessionNotFound:     "session not found or expired",
+	CodePaymentCompleted:    "payment of session is already completed",
+	CodeSessionRequired:     "token of session is required",
+	CodeUnknownBank:         "payment url does not belong to any known bank",
+	CodeDestinationRejected: "destination is not allowed",
+	CodeBankUnavailable:     "bank is temporarily unavailable",
+	CodeTimeout:             "step timed out",
+	CodeBankUnreachable:     "bank is unreachable",
+	CodeBankHTTPStatus:      "bank responded with unexpected http status",
+	CodeBankResponse:        "bank response could not be read",
+	CodeStepFailed:          "step failed",
+}
+
+// ErrorResponse is returned with every non 200 response of workflow endpoints
+type ErrorResponse struct {
+	Status    pkg.HackResponseStatus `json:"status"`
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	RequestId string                 `json:"request-id,omitempty"`
+	// step and part of workflow which failed, if any
+	Step pkg.Step `json:"step,omitempty"`
+	Part string   `json:"part,omitempty"`
+	// first field of request which did not pass validation, if any
+	Field string `json:"field,omitempty"`
+	// every field which did not pass validation
+	Fields []pkg.FieldError `json:"fields,omitempty"`
+}
+
+func errorResponse(ctx context.Context, clog *log.Entry, w http.ResponseWriter, httpStatus int, resp ErrorResponse) {
+	resp.RequestId = requestIdFromContext(ctx)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		clog.WithError(err).Error("error in json.Encode")
+	}
+}
+
+// invalidRequest responds to request which did not pass validation
+func invalidRequest(ctx context.Context, clog *log.Entry, w http.ResponseWriter, code, message string) {
+	errorResponse(ctx, clog, w, http.StatusBadRequest, ErrorResponse{
+		Status:  pkg.HackResponseStatusInvalidRequest,
+		Code:    code,
+		Message: message,
+	})
+}
+
+// stepFailed responds to failed step of workflow with status computed by service
+func stepFailed(ctx context.Context, clog *log.Entry, w http.ResponseWriter, status pkg.HackResponseStatus, err error) {
+	code := errorCode(err)
+	resp := ErrorResponse{
+		Status:  status,
+		Code:    code,
+		Message: codeMessages[code],
+	}
+	var opErr *pkg.OperationError
+	if errors.As(err, &opErr) {
+		resp.Step = opErr.Step
+		resp.Part = opErr.Part
+	}
+	var invalid *pkg.ValidationError
+	if errors.As(err, &invalid) && len(invalid.Fields) > 0 {
+		resp.Message = invalid.Fields[0].Message
+		resp.Field = invalid.Fields[0].Field
+		resp.Fields = invalid.Fields
+	}
+	errorResponse(ctx, clog, w, httpStatusOf(status), resp)
+}
+
+func errorCode(err error) string {
+	var network *pkg.NetworkError
+	var unexpected *pkg.UnexpectedStatusError
+	var parse *pkg.ParseError
+	var invalid *pkg.ValidationError
+	switch {
+	case errors.As(err, &invalid) && len(invalid.Fields) > 0:
+		return invalid.Fields[0].Code
+	case errors.Is(err, pkg.ErrSessionNotFound):
+		return CodeSessionNotFound
+	case errors.Is(err, pkg.ErrPaymentCompleted):
+		return CodePaymentCompleted
+	case errors.Is(err, pkg.ErrSessionRequired):
+		return CodeSessionRequired
+	case errors.Is(err, pkg.ErrUnknownBank):
+		return CodeUnknownBank
+	case errors.Is(err, pkg.ErrDestinationRejected):
+		return CodeDestinationRejected
+	case errors.Is(err, pkg.ErrBankUnavailable):
+		return CodeBankUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	case errors.As(err, &network):
+		return CodeBankUnreachable
+	case errors.As(err, &unexpected):
+		return CodeBankHTTPStatus
+	case errors.As(err, &parse):
+		return CodeBankResponse
+	default:
+		return CodeStepFailed
+	}
+}
+
+func httpStatusOf(status pkg.HackResponseStatus) int {
+	switch status {
+	case pkg.HackResponseStatusNetworkError:
+		return http.StatusBadGateway
+	case pkg.HackResponseStatusAlreadyProcessed:
+		return http.StatusConflict
+	case pkg.HackResponseStatusUnknownBank, pkg.HackResponseStatusRejectedDestination:
+		return http.StatusUnprocessableEntity
+	case pkg.HackResponseStatusInvalidRequest:
+		return http.StatusBadRequest
+	case pkg.HackResponseStatusBankUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/apex/log"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
 	"ykjam/bpchack/pkg"
 )
@@ -20,17 +22,37 @@ type HandlerContext interface {
 	HandleSubmitCard(w http.ResponseWriter, r *http.Request)
 	HandleResendCode(w http.ResponseWriter, r *http.Request)
 	HandleConfirmPayment(w http.ResponseWriter, r *http.Request)
+	HandleOrderStatus(w http.ResponseWriter, r *http.Request)
+	// v2 handlers accept json bodies with field names of pkg requests
+	HandleStartHackV2(w http.ResponseWriter, r *http.Request)
+	HandleSubmitCardV2(w http.ResponseWriter, r *http.Request)
+	HandleResendCodeV2(w http.ResponseWriter, r *http.Request)
+	HandleConfirmPaymentV2(w http.ResponseWriter, r *http.Request)
+	HandleOrderStatusV2(w http.ResponseWriter, r *http.Request)
+	// HandleDebugSession exposes session state with bank cookies, should not be enabled in production
+	HandleDebugSession(w http.ResponseWriter, r *http.Request)
+	// HandleAdminBreakers responds with state of circuit breakers of bank MPI hosts
+	HandleAdminBreakers(w http.ResponseWriter, r *http.Request)
 }
 
 type handlerContext struct {
 	service      pkg.Service
 	rApplication *regexp.Regexp
 	rIdentity    *regexp.Regexp
-	rCardNumber  *regexp.Regexp
-	rCardExpiry  *regexp.Regexp
-	rCardCVC     *regexp.Regexp
+	limiter      RateLimiter
 }
 
+type HandlerOption func(c *handlerContext)
+
+// WithRateLimiter limits requests to workflow endpoints, there are no limits by default
+func WithRateLimiter(limiter RateLimiter) HandlerOption {
+	return func(c *handlerContext) {
+		c.limiter = limiter
+	}
+}
+
+var traceContext = propagation.TraceContext{}
+
 type httpPostWithLog func(w http.ResponseWriter, r *http.Request, ctx context.Context, clog *log.Entry)
 
 func GetRemoteAddress(r *http.Request) string {
@@ -43,21 +65,6 @@ func GetRemoteAddress(r *http.Request) string {
 	}
 }
 
-func errorHandler(w http.ResponseWriter, status int) {
-	w.WriteHeader(status)
-	if status == http.StatusNotFound {
-		_, _ = fmt.Fprint(w, "Page not found")
-
-	} else {
-		_, _ = fmt.Fprintf(w, "HTTP %d error", status)
-	}
-}
-
-func errorHandlerWithError(w http.ResponseWriter, status int, err error) {
-	w.WriteHeader(status)
-	_, _ = fmt.Fprintf(w, "HTTP %d error\nError %v", status, err)
-}
-
 func responseWithCodeAndMessage(w http.ResponseWriter, status int, message string) {
 	w.WriteHeader(status)
 	_, _ = fmt.Fprintln(w, message)
@@ -73,7 +80,13 @@ func jsonResponse(clog *log.Entry, w http.ResponseWriter, response interface{})
 }
 
 func (c *handlerContext) handleHttpPostWithLog(handleName string, w http.ResponseWriter, r *http.Request, f httpPostWithLog) {
-	ctx := r.Context()
+	// request id is normally assigned by RequestId middleware
+	ctx := requestContext(w, r)
+	// spans of service continue trace of calling application, if it sent traceparent
+	ctx = traceContext.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		ctx = log.NewContext(ctx, log.FromContext(ctx).WithField("trace-id", sc.TraceID().String()))
+	}
 	clog := log.FromContext(ctx).
 		WithFields(log.Fields{
 			"remote-addr": GetRemoteAddress(r),
@@ -85,7 +98,11 @@ func (c *handlerContext) handleHttpPostWithLog(handleName string, w http.Respons
 		f(w, r, ctx, clog)
 	} else {
 		clog.Error("invalid request, method not allowed")
-		errorHandler(w, http.StatusMethodNotAllowed)
+		errorResponse(ctx, clog, w, http.StatusMethodNotAllowed, ErrorResponse{
+			Status:  pkg.HackResponseStatusInvalidRequest,
+			Code:    CodeMethodNotAllowed,
+			Message: "only POST method is allowed",
+		})
 	}
 }
 
@@ -98,48 +115,46 @@ func (c *handlerContext) isApplicationAndIdentityValid(application, identity str
 	return true
 }
 
-func (c *handlerContext) isCardValid(clog *log.Entry, cardNumber, cardExpiry, nameOnCard, cvcCode string) bool {
-	if !c.rCardNumber.MatchString(cardNumber) {
-		clog.WithField("card-number", cardNumber).Error("card number validation failed")
-		return false
-	} else if !c.rCardExpiry.MatchString(cardExpiry) {
-		clog.WithField("card-expiry", cardExpiry).Error("card expiry validation failed")
-		return false
-	} else if len(nameOnCard) < 4 || len(nameOnCard) > 32 {
-		clog.WithField("name-on-card", nameOnCard).Error("name on card validation failed")
-		return false
-	} else if cvcCode != "" && !c.rCardCVC.MatchString(cvcCode) {
-		clog.WithField("cvc", cvcCode).Error("cvc code validation failed")
-		return false
-	}
-	return true
+func (c *handlerContext) HandleStartHack(w http.ResponseWriter, r *http.Request) {
+	c.handleStartHack("handleStartHack", w, r, func(r *http.Request) (req pkg.StartHackRequest, err error) {
+		req.Application = r.FormValue("app")
+		req.Identity = r.FormValue("id")
+		req.PaymentUrl = r.FormValue("url")
+		req.ReturnUrl = r.FormValue("return-url")
+		req.FailUrl = r.FormValue("fail-url")
+		return
+	})
 }
 
-func (c *handlerContext) HandleStartHack(w http.ResponseWriter, r *http.Request) {
-	h := "handleStartHack"
+func (c *handlerContext) handleStartHack(h string, w http.ResponseWriter, r *http.Request, read func(r *http.Request) (pkg.StartHackRequest, error)) {
 	c.handleHttpPostWithLog(h, w, r, func(w http.ResponseWriter, r *http.Request, ctx context.Context, clog *log.Entry) {
 		// request parameters
-		application := r.FormValue("app")
-		identity := r.FormValue("id")
-		paymentUrl := r.FormValue("url")
+		req, err := read(r)
+		if err != nil {
+			clog.WithError(err).Warn("error reading request")
+			invalidRequest(ctx, clog, w, CodeMalformedRequest, err.Error())
+			return
+		}
 		// validate inputs
-		if !c.isApplicationAndIdentityValid(application, identity) {
+		if !c.isApplicationAndIdentityValid(req.Application, req.Identity) {
 			clog.Warn("not valid application or identity, ignoring request")
-			errorHandler(w, http.StatusBadRequest)
+			invalidRequest(ctx, clog, w, CodeInvalidApplication, "application or identity is not valid")
+			return
+		}
+		if !authorizedFor(ctx, clog, w, req.Application) {
+			return
+		}
+		if !c.allowed(ctx, clog, w, pkg.StepStartHack, req.Application, req.Identity, "", mdOrderOf(req.PaymentUrl)) {
 			return
 		}
 		clog.WithFields(log.Fields{
-			"application": application,
-			"identity":    identity,
+			"application": req.Application,
+			"identity":    req.Identity,
 		}).Debug("request received")
-		resp, err := c.service.Step1StartHack(ctx, pkg.StartHackRequest{
-			Application: application,
-			Identity:    identity,
-			PaymentUrl:  paymentUrl,
-		})
-		if err != nil {
+		resp, err := c.service.Step1StartHack(ctx, req)
+		if err != nil && !pkg.IsBankAnswer(err) {
 			clog.WithError(err).Error("step1 start hack failed")
-			errorHandlerWithError(w, http.StatusInternalServerError, err)
+			stepFailed(ctx, clog, w, resp.Status, err)
 			return
 		}
 		jsonResponse(clog, w, resp)
@@ -147,43 +162,48 @@ func (c *handlerContext) HandleStartHack(w http.ResponseWriter, r *http.Request)
 }
 
 func (c *handlerContext) HandleSubmitCard(w http.ResponseWriter, r *http.Request) {
-	h := "handleSubmitCard"
+	c.handleSubmitCard("handleSubmitCard", w, r, func(r *http.Request) (req pkg.SubmitCardRequest, err error) {
+		req.Application = r.FormValue("app")
+		req.Identity = r.FormValue("id")
+		req.Token = r.FormValue("token")
+		req.MDOrder = r.FormValue("md-order")
+		req.CardNumber = r.FormValue("card-number")
+		req.Expiry = r.FormValue("card-expiry")
+		req.NameOnCard = r.FormValue("name-on-card")
+		req.CVCCode = r.FormValue("card-cvc")
+		return
+	})
+}
+
+func (c *handlerContext) handleSubmitCard(h string, w http.ResponseWriter, r *http.Request, read func(r *http.Request) (pkg.SubmitCardRequest, error)) {
 	c.handleHttpPostWithLog(h, w, r, func(w http.ResponseWriter, r *http.Request, ctx context.Context, clog *log.Entry) {
 		// request parameters
-		application := r.FormValue("app")
-		identity := r.FormValue("id")
-		mdOrder := r.FormValue("md-order")
-		cardNumber := r.FormValue("card-number")
-		cardExpiry := r.FormValue("card-expiry")
-		nameOnCard := r.FormValue("name-on-card")
-		cvcCode := r.FormValue("card-cvc")
+		req, err := read(r)
+		if err != nil {
+			clog.WithError(err).Warn("error reading request")
+			invalidRequest(ctx, clog, w, CodeMalformedRequest, err.Error())
+			return
+		}
 		// validate inputs
-		if !c.isApplicationAndIdentityValid(application, identity) {
+		if !c.isApplicationAndIdentityValid(req.Application, req.Identity) {
 			clog.Warn("not valid application or identity, ignoring request")
-			errorHandler(w, http.StatusBadRequest)
+			invalidRequest(ctx, clog, w, CodeInvalidApplication, "application or identity is not valid")
+			return
+		}
+		if !authorizedFor(ctx, clog, w, req.Application) {
 			return
 		}
-		if !c.isCardValid(clog, cardNumber, cardExpiry, nameOnCard, cvcCode) {
-			clog.Warn("not valid card details, ignoring request")
-			errorHandler(w, http.StatusBadRequest)
+		if !c.allowed(ctx, clog, w, pkg.StepSubmitCard, req.Application, req.Identity, req.Token, req.MDOrder) {
 			return
 		}
 		clog.WithFields(log.Fields{
-			"application": application,
-			"identity":    identity,
+			"application": req.Application,
+			"identity":    req.Identity,
 		}).Debug("request received")
-		resp, err := c.service.Step2SubmitCard(ctx, pkg.SubmitCardRequest{
-			Application: application,
-			Identity:    identity,
-			MDOrder:     mdOrder,
-			CardNumber:  cardNumber,
-			Expiry:      cardExpiry,
-			NameOnCard:  nameOnCard,
-			CVCCode:     cvcCode,
-		})
-		if err != nil {
+		resp, err := c.service.Step2SubmitCard(ctx, req)
+		if err != nil && !pkg.IsBankAnswer(err) {
 			clog.WithError(err).Error("step2 submit card failed")
-			errorHandlerWithError(w, http.StatusInternalServerError, err)
+			stepFailed(ctx, clog, w, resp.Status, err)
 			return
 		}
 		jsonResponse(clog, w, resp)
@@ -191,32 +211,45 @@ func (c *handlerContext) HandleSubmitCard(w http.ResponseWriter, r *http.Request
 }
 
 func (c *handlerContext) HandleResendCode(w http.ResponseWriter, r *http.Request) {
-	h := "handleResendCode"
+	c.handleResendCode("handleResendCode", w, r, func(r *http.Request) (req pkg.ResendCodeRequest, err error) {
+		req.Application = r.FormValue("app")
+		req.Identity = r.FormValue("id")
+		req.Token = r.FormValue("token")
+		req.ACSRequestId = r.FormValue("acs-req-id")
+		req.ACSSessionUrl = r.FormValue("acs-session-url")
+		return
+	})
+}
+
+func (c *handlerContext) handleResendCode(h string, w http.ResponseWriter, r *http.Request, read func(r *http.Request) (pkg.ResendCodeRequest, error)) {
 	c.handleHttpPostWithLog(h, w, r, func(w http.ResponseWriter, r *http.Request, ctx context.Context, clog *log.Entry) {
 		// request parameters
-		application := r.FormValue("app")
-		identity := r.FormValue("id")
-		acsRequestId := r.FormValue("acs-req-id")
-		acsSessionUrl := r.FormValue("acs-session-url")
+		req, err := read(r)
+		if err != nil {
+			clog.WithError(err).Warn("error reading request")
+			invalidRequest(ctx, clog, w, CodeMalformedRequest, err.Error())
+			return
+		}
 		// validate inputs
-		if !c.isApplicationAndIdentityValid(application, identity) {
+		if !c.isApplicationAndIdentityValid(req.Application, req.Identity) {
 			clog.Warn("not valid application or identity, ignoring request")
-			errorHandler(w, http.StatusBadRequest)
+			invalidRequest(ctx, clog, w, CodeInvalidApplication, "application or identity is not valid")
+			return
+		}
+		if !authorizedFor(ctx, clog, w, req.Application) {
+			return
+		}
+		if !c.allowed(ctx, clog, w, pkg.StepResendCode, req.Application, req.Identity, req.Token, req.ACSRequestId) {
 			return
 		}
 		clog.WithFields(log.Fields{
-			"application": application,
-			"identity":    identity,
+			"application": req.Application,
+			"identity":    req.Identity,
 		}).Debug("request received")
-		resp, err := c.service.Step3ResendCode(ctx, pkg.ResendCodeRequest{
-			Application:   application,
-			Identity:      identity,
-			ACSRequestId:  acsRequestId,
-			ACSSessionUrl: acsSessionUrl,
-		})
-		if err != nil {
+		resp, err := c.service.Step3ResendCode(ctx, req)
+		if err != nil && !pkg.IsBankAnswer(err) {
 			clog.WithError(err).Error("step3 resend code failed")
-			errorHandlerWithError(w, http.StatusInternalServerError, err)
+			stepFailed(ctx, clog, w, resp.Status, err)
 			return
 		}
 		jsonResponse(clog, w, resp)
@@ -224,52 +257,158 @@ func (c *handlerContext) HandleResendCode(w http.ResponseWriter, r *http.Request
 }
 
 func (c *handlerContext) HandleConfirmPayment(w http.ResponseWriter, r *http.Request) {
-	h := "handleConfirmPayment"
+	c.handleConfirmPayment("handleConfirmPayment", w, r, func(r *http.Request) (req pkg.ConfirmPaymentRequest, err error) {
+		req.Application = r.FormValue("app")
+		req.Identity = r.FormValue("id")
+		req.Token = r.FormValue("token")
+		req.MDOrder = r.FormValue("md-order")
+		req.ACSRequestId = r.FormValue("acs-req-id")
+		req.ACSSessionUrl = r.FormValue("acs-session-url")
+		req.OneTimePassword = r.FormValue("otp")
+		req.TerminateUrl = r.FormValue("term-url")
+		return
+	})
+}
+
+func (c *handlerContext) handleConfirmPayment(h string, w http.ResponseWriter, r *http.Request, read func(r *http.Request) (pkg.ConfirmPaymentRequest, error)) {
 	c.handleHttpPostWithLog(h, w, r, func(w http.ResponseWriter, r *http.Request, ctx context.Context, clog *log.Entry) {
 		// request parameters
-		application := r.FormValue("app")
-		identity := r.FormValue("id")
-		mdOrder := r.FormValue("md-order")
-		acsRequestId := r.FormValue("acs-req-id")
-		acsSessionUrl := r.FormValue("acs-session-url")
-		oneTimePassword := r.FormValue("otp")
-		terminateUrl := r.FormValue("term-url")
+		req, err := read(r)
+		if err != nil {
+			clog.WithError(err).Warn("error reading request")
+			invalidRequest(ctx, clog, w, CodeMalformedRequest, err.Error())
+			return
+		}
 		clog.WithFields(log.Fields{
-			"application": application,
-			"identity":    identity,
-			"md-order":    mdOrder,
-			"acs-req-id":  acsRequestId,
-			"acs-ses-url": acsSessionUrl,
-			"otp-code":    oneTimePassword,
+			"application": req.Application,
+			"identity":    req.Identity,
+			"md-order":    req.MDOrder,
+			"acs-req-id":  req.ACSRequestId,
+			"acs-ses-url": req.ACSSessionUrl,
 		}).Debug("request received")
 		// validate inputs
-		if !c.isApplicationAndIdentityValid(application, identity) {
+		if !c.isApplicationAndIdentityValid(req.Application, req.Identity) {
 			clog.Warn("not valid application or identity, ignoring request")
-			errorHandler(w, http.StatusBadRequest)
+			invalidRequest(ctx, clog, w, CodeInvalidApplication, "application or identity is not valid")
+			return
+		}
+		if !authorizedFor(ctx, clog, w, req.Application) {
+			return
+		}
+		if !c.allowed(ctx, clog, w, pkg.StepConfirmPayment, req.Application, req.Identity, req.Token, req.ACSRequestId) {
+			return
+		}
+		resp, err := c.service.Step4ConfirmPayment(ctx, req)
+		if err != nil && !pkg.IsBankAnswer(err) {
+			clog.WithError(err).Error("step4 confirm payment failed")
+			stepFailed(ctx, clog, w, resp.Status, err)
+			return
+		}
+		jsonResponse(clog, w, resp)
+	})
+}
+
+func (c *handlerContext) HandleOrderStatus(w http.ResponseWriter, r *http.Request) {
+	c.handleOrderStatus("handleOrderStatus", w, r, func(r *http.Request) (req pkg.OrderStatusRequest, err error) {
+		req.Application = r.FormValue("app")
+		req.Identity = r.FormValue("id")
+		req.Token = r.FormValue("token")
+		req.MDOrder = r.FormValue("md-order")
+		return
+	})
+}
+
+func (c *handlerContext) handleOrderStatus(h string, w http.ResponseWriter, r *http.Request, read func(r *http.Request) (pkg.OrderStatusRequest, error)) {
+	c.handleHttpPostWithLog(h, w, r, func(w http.ResponseWriter, r *http.Request, ctx context.Context, clog *log.Entry) {
+		// request parameters
+		req, err := read(r)
+		if err != nil {
+			clog.WithError(err).Warn("error reading request")
+			invalidRequest(ctx, clog, w, CodeMalformedRequest, err.Error())
 			return
 		}
 		clog.WithFields(log.Fields{
-			"application": application,
-			"identity":    identity,
+			"application": req.Application,
+			"identity":    req.Identity,
+			"md-order":    req.MDOrder,
 		}).Debug("request received")
-		resp, err := c.service.Step4ConfirmPayment(ctx, pkg.ConfirmPaymentRequest{
-			Application:     application,
-			Identity:        identity,
-			MDOrder:         mdOrder,
-			ACSRequestId:    acsRequestId,
-			ACSSessionUrl:   acsSessionUrl,
-			OneTimePassword: oneTimePassword,
-			TerminateUrl:    terminateUrl,
+		// validate inputs
+		if !c.isApplicationAndIdentityValid(req.Application, req.Identity) {
+			clog.Warn("not valid application or identity, ignoring request")
+			invalidRequest(ctx, clog, w, CodeInvalidApplication, "application or identity is not valid")
+			return
+		}
+		if !authorizedFor(ctx, clog, w, req.Application) {
+			return
+		}
+		if !c.allowed(ctx, clog, w, pkg.StepOrderStatus, req.Application, req.Identity, req.Token, req.MDOrder) {
+			return
+		}
+		resp, err := c.service.Step5OrderStatus(ctx, req)
+		if err != nil && !pkg.IsBankAnswer(err) {
+			clog.WithError(err).Error("step5 order status failed")
+			stepFailed(ctx, clog, w, resp.Status, err)
+			return
+		}
+		jsonResponse(clog, w, resp)
+	})
+}
+
+func (c *handlerContext) HandleDebugSession(w http.ResponseWriter, r *http.Request) {
+	h := "handleDebugSession"
+	c.handleHttpPostWithLog(h, w, r, func(w http.ResponseWriter, r *http.Request, ctx context.Context, clog *log.Entry) {
+		// request parameters
+		application := r.FormValue("app")
+		identity := r.FormValue("id")
+		token := r.FormValue("token")
+		// validate inputs
+		if !c.isApplicationAndIdentityValid(application, identity) {
+			clog.Warn("not valid application or identity, ignoring request")
+			invalidRequest(ctx, clog, w, CodeInvalidApplication, "application or identity is not valid")
+			return
+		}
+		if !authorizedFor(ctx, clog, w, application) {
+			return
+		}
+		resp, err := c.service.InspectSession(ctx, pkg.InspectSessionRequest{
+			Application: application,
+			Identity:    identity,
+			Token:       token,
 		})
 		if err != nil {
-			clog.WithError(err).Error("step4 confirm payment failed")
-			errorHandlerWithError(w, http.StatusInternalServerError, err)
+			clog.WithError(err).Error("inspect session failed")
+			stepFailed(ctx, clog, w, resp.Status, err)
 			return
 		}
 		jsonResponse(clog, w, resp)
 	})
 }
 
+func (c *handlerContext) HandleAdminBreakers(w http.ResponseWriter, r *http.Request) {
+	clog := log.FromContext(r.Context()).WithFields(log.Fields{
+		"remote-addr": GetRemoteAddress(r),
+		"uri":         r.RequestURI,
+		"method":      r.Method,
+		"handle":      "handleAdminBreakers",
+	})
+	if r.Method != http.MethodGet {
+		clog.Error("invalid request, method not allowed")
+		errorResponse(r.Context(), clog, w, http.StatusMethodNotAllowed, ErrorResponse{
+			Status:  pkg.HackResponseStatusInvalidRequest,
+			Code:    CodeMethodNotAllowed,
+			Message: "only GET method is allowed",
+		})
+		return
+	}
+	resp, err := c.service.InspectBreakers(r.Context())
+	if err != nil {
+		clog.WithError(err).Error("inspect breakers failed")
+		stepFailed(r.Context(), clog, w, pkg.StatusFromError(err), err)
+		return
+	}
+	jsonResponse(clog, w, resp)
+}
+
 func (c *handlerContext) HandleUtilityEpoch(w http.ResponseWriter, _ *http.Request) {
 	epoch := time.Now().Unix()
 	responseWithCodeAndMessage(w, http.StatusOK, fmt.Sprintf("%d", epoch))
@@ -280,13 +419,14 @@ func (c *handlerContext) HandleUtilityIP(w http.ResponseWriter, r *http.Request)
 	responseWithCodeAndMessage(w, http.StatusOK, remoteIp)
 }
 
-func NewHandlerContext(service pkg.Service) HandlerContext {
-	return &handlerContext{
+func NewHandlerContext(service pkg.Service, opts ...HandlerOption) HandlerContext {
+	c := &handlerContext{
 		service:      service,
-		rApplication: regexp.MustCompile(`(?i)[a-z0-9]{3,16}`),
-		rIdentity:    regexp.MustCompile(`(?i)[a-z0-9]{3,64}`),
-		rCardNumber:  regexp.MustCompile(`[0-9]{16}`),
-		rCardExpiry:  regexp.MustCompile(`[0-9]{6}`),
-		rCardCVC:     regexp.MustCompile(`[0-9]{3}`),
+		rApplication: regexp.MustCompile(`^(?:` + pkg.ApplicationPattern + `)$`),
+		rIdentity:    regexp.MustCompile(`^(?:` + pkg.IdentityPattern + `)$`),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
@@ -0,0 +1,706 @@
+package web_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"ykjam/bpchack/pkg"
+	"ykjam/bpchack/pkg/bpc/mock"
+	"ykjam/bpchack/pkg/card"
+	"ykjam/bpchack/pkg/web"
+)
+
+const (
+	testApplication = "testapp"
+	testIdentity    = "user42"
+	testMDOrder     = "0a1b2c3d-0000-4000-8000-000000000001"
+)
+
+type handlerEnv struct {
+	bank    *httptest.Server
+	handler web.HandlerContext
+}
+
+// handlerEnvConfig is what service and handler of env are created with
+type handlerEnvConfig struct {
+	// url of mock bank
+	bankUrl string
+	// profile of mock bank
+	profile        pkg.BankProfile
+	options        []pkg.Option
+	handlerOptions []web.HandlerOption
+}
+
+type handlerEnvOption func(c *handlerEnvConfig)
+
+// withBankProfile changes profile of mock bank, url of mock is given to build urls of bank
+func withBankProfile(change func(profile *pkg.BankProfile, bankUrl string)) handlerEnvOption {
+	return func(c *handlerEnvConfig) {
+		change(&c.profile, c.bankUrl)
+	}
+}
+
+func withServiceOptions(options ...pkg.Option) handlerEnvOption {
+	return func(c *handlerEnvConfig) {
+		c.options = append(c.options, options...)
+	}
+}
+
+func withRateLimits(limits web.RateLimits) handlerEnvOption {
+	return func(c *handlerEnvConfig) {
+		c.handlerOptions = append(c.handlerOptions, web.WithRateLimiter(web.NewRateLimiter(limits)))
+	}
+}
+
+func newHandlerEnv(t *testing.T, scenarioName string, options ...handlerEnvOption) *handlerEnv {
+	t.Helper()
+	scenario, ok := mock.ScenarioByName(scenarioName)
+	if !ok {
+		t.Fatalf("unknown scenario %s", scenarioName)
+	}
+	bank := httptest.NewServer(mock.NewServer(scenario))
+	t.Cleanup(bank.Close)
+	c := handlerEnvConfig{
+		bankUrl: bank.URL,
+		profile: pkg.BankProfile{
+			Name:            "mock",
+			BaseMpiUrl:      bank.URL + mock.MPIPath,
+			AllowedNetworks: []string{"127.0.0.0/8"},
+		},
+		options: []pkg.Option{pkg.WithTimeout(5 * time.Second)},
+	}
+	for _, option := range options {
+		option(&c)
+	}
+	service := pkg.NewService([]pkg.BankProfile{c.profile}, c.options...)
+	return &handlerEnv{
+		bank:    bank,
+		handler: web.NewHandlerContext(service, c.handlerOptions...),
+	}
+}
+
+// post submits form to handler, decodes json response into v if response status is 200
+func post(t *testing.T, h http.HandlerFunc, form url.Values, v interface{}) (int, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h(w, r)
+	body := w.Body.String()
+	if w.Code == http.StatusOK && v != nil {
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("content type = %s, want application/json", ct)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("error decoding response %q: %v", body, err)
+		}
+	}
+	return w.Code, body
+}
+
+func decodeError(t *testing.T, body string) web.ErrorResponse {
+	t.Helper()
+	var resp web.ErrorResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("error decoding error response %q: %v", body, err)
+	}
+	return resp
+}
+
+// postJSON submits json body to handler, decodes json response into v if response status is 200
+func postJSON(t *testing.T, h http.HandlerFunc, body interface{}, v interface{}) (int, string) {
+	t.Helper()
+	raw, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("error encoding request: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code == http.StatusOK && v != nil {
+		if err = json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("error decoding response %q: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code, w.Body.String()
+}
+
+func (e *handlerEnv) startForm() url.Values {
+	return e.startFormOf(testMDOrder)
+}
+
+func (e *handlerEnv) startFormOf(mdOrder string) url.Values {
+	return url.Values{
+		"app": {testApplication},
+		"id":  {testIdentity},
+		"url": {e.bank.URL + "/payment/merchants/mock/payment_ru.html?mdOrder=" + mdOrder},
+	}
+}
+
+func cardForm(token, cvc string) url.Values {
+	return url.Values{
+		"app":          {testApplication},
+		"id":           {testIdentity},
+		"token":        {token},
+		"card-number":  {"4111111111111111"},
+		"card-expiry":  {"203012"},
+		"name-on-card": {"TEST CARDHOLDER"},
+		"card-cvc":     {cvc},
+	}
+}
+
+func confirmForm(token, otp string) url.Values {
+	return url.Values{
+		"app":   {testApplication},
+		"id":    {testIdentity},
+		"token": {token},
+		"otp":   {otp},
+	}
+}
+
+func (e *handlerEnv) start(t *testing.T) pkg.StartHackResponse {
+	t.Helper()
+	var resp pkg.StartHackResponse
+	code, body := post(t, e.handler.HandleStartHack, e.startForm(), &resp)
+	if code != http.StatusOK || resp.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("start hack = %d %s", code, body)
+	}
+	return resp
+}
+
+func (e *handlerEnv) submitCard(t *testing.T, token string) {
+	t.Helper()
+	var resp pkg.SubmitCardResponse
+	code, body := post(t, e.handler.HandleSubmitCard, cardForm(token, ""), &resp)
+	if code != http.StatusOK || resp.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("submit card = %d %s", code, body)
+	}
+}
+
+func TestHandleWorkflowOk(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess)
+	step1 := e.start(t)
+	if step1.Token == "" || step1.MDOrder != testMDOrder || step1.AmountInfo == "" {
+		t.Errorf("start hack = %+v", step1)
+	}
+
+	var step2 pkg.SubmitCardResponse
+	code, _ := post(t, e.handler.HandleSubmitCard, cardForm(step1.Token, ""), &step2)
+	if code != http.StatusOK || step2.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("submit card = %d %v", code, step2)
+	}
+	if step2.ThreeDSecureNumber == "" || step2.ResendAttemptsLeft != 3 {
+		t.Errorf("submit card = %v", step2)
+	}
+
+	var step3 pkg.ResendCodeResponse
+	code, _ = post(t, e.handler.HandleResendCode, url.Values{
+		"app":   {testApplication},
+		"id":    {testIdentity},
+		"token": {step1.Token},
+	}, &step3)
+	if code != http.StatusOK || step3.Status != pkg.HackResponseStatusOk || step3.ResendAttemptsLeft != 2 {
+		t.Errorf("resend code = %d %v", code, step3)
+	}
+
+	var step4 pkg.ConfirmPaymentResponse
+	code, _ = post(t, e.handler.HandleConfirmPayment, confirmForm(step1.Token, mock.DefaultOTP), &step4)
+	if code != http.StatusOK || step4.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("confirm payment = %d %v", code, step4)
+	}
+	if !strings.HasPrefix(step4.FinalUrl, e.bank.URL) {
+		t.Errorf("final url = %s", step4.FinalUrl)
+	}
+	if step4.Outcome == nil || step4.Outcome.OrderId != testMDOrder {
+		t.Errorf("payment outcome = %+v", step4.Outcome)
+	}
+
+	var step5 pkg.OrderStatusResponse
+	code, _ = post(t, e.handler.HandleOrderStatus, url.Values{
+		"app":   {testApplication},
+		"id":    {testIdentity},
+		"token": {step1.Token},
+	}, &step5)
+	if code != http.StatusOK || step5.Status != pkg.HackResponseStatusOk || step5.Outcome != pkg.OrderOutcomeDeposited {
+		t.Errorf("order status = %d %v", code, step5)
+	}
+
+	// token of completed payment is good for order status only
+	code, body := post(t, e.handler.HandleConfirmPayment, confirmForm(step1.Token, mock.DefaultOTP), nil)
+	if code != http.StatusConflict {
+		t.Fatalf("repeated confirm payment = %d %s", code, body)
+	}
+	if resp := decodeError(t, body); resp.Code != web.CodePaymentCompleted {
+		t.Errorf("error response = %+v", resp)
+	}
+}
+
+func TestHandleWorkflowV2(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess)
+	var step1 pkg.StartHackResponse
+	code, body := postJSON(t, e.handler.HandleStartHackV2, map[string]string{
+		"application": testApplication,
+		"identity":    testIdentity,
+		"payment-url": e.bank.URL + "/payment/merchants/mock/payment_ru.html?mdOrder=" + testMDOrder,
+	}, &step1)
+	if code != http.StatusOK || step1.Status != pkg.HackResponseStatusOk || step1.Token == "" {
+		t.Fatalf("start hack = %d %s", code, body)
+	}
+
+	var step2 pkg.SubmitCardResponse
+	code, body = postJSON(t, e.handler.HandleSubmitCardV2, pkg.SubmitCardRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		Token:       step1.Token,
+		CardNumber:  "4111111111111111",
+		Expiry:      "203012",
+		NameOnCard:  "TEST CARDHOLDER",
+	}, &step2)
+	if code != http.StatusOK || step2.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("submit card = %d %s", code, body)
+	}
+
+	var step3 pkg.ResendCodeResponse
+	code, body = postJSON(t, e.handler.HandleResendCodeV2, pkg.ResendCodeRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		Token:       step1.Token,
+	}, &step3)
+	if code != http.StatusOK || step3.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("resend code = %d %s", code, body)
+	}
+
+	var step4 pkg.ConfirmPaymentResponse
+	code, body = postJSON(t, e.handler.HandleConfirmPaymentV2, map[string]string{
+		"application":       testApplication,
+		"identity":          testIdentity,
+		"token":             step1.Token,
+		"one-time-password": mock.DefaultOTP,
+	}, &step4)
+	if code != http.StatusOK || step4.Status != pkg.HackResponseStatusOk {
+		t.Fatalf("confirm payment = %d %s", code, body)
+	}
+
+	var step5 pkg.OrderStatusResponse
+	code, body = postJSON(t, e.handler.HandleOrderStatusV2, pkg.OrderStatusRequest{
+		Application: testApplication,
+		Identity:    testIdentity,
+		MDOrder:     testMDOrder,
+	}, &step5)
+	if code != http.StatusOK || step5.Outcome != pkg.OrderOutcomeDeposited || step5.MDOrder != testMDOrder {
+		t.Fatalf("order status = %d %s", code, body)
+	}
+}
+
+func TestHandleV2RequiresJSON(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess)
+	code, body := post(t, e.handler.HandleStartHackV2, url.Values{
+		"application": {testApplication},
+		"identity":    {testIdentity},
+	}, nil)
+	if code != http.StatusBadRequest {
+		t.Errorf("form body = %d %s, want %d", code, body, http.StatusBadRequest)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"application":`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	e.handler.HandleStartHackV2(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("malformed json = %d %s, want %d", w.Code, w.Body.String(), http.StatusBadRequest)
+	}
+}
+
+func TestHandleStartHackAlreadyProcessed(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSessionExpired)
+	var resp pkg.StartHackResponse
+	code, body := post(t, e.handler.HandleStartHack, e.startForm(), &resp)
+	if code != http.StatusOK || resp.Status != pkg.HackResponseStatusAlreadyProcessed {
+		t.Errorf("start hack = %d %s", code, body)
+	}
+}
+
+func TestHandleStartHackNetworkError(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess)
+	form := e.startForm()
+	e.bank.Close()
+	code, body := post(t, e.handler.HandleStartHack, form, nil)
+	if code != http.StatusBadGateway {
+		t.Fatalf("start hack = %d %s", code, body)
+	}
+	resp := decodeError(t, body)
+	if resp.Status != pkg.HackResponseStatusNetworkError || resp.Step != pkg.StepStartHack ||
+		resp.Part != pkg.PartSessionStatus || resp.RequestId == "" {
+		t.Errorf("error response = %+v", resp)
+	}
+	// url of bank is only logged
+	if host := strings.TrimPrefix(e.bank.URL, "http://"); strings.Contains(body, host) {
+		t.Errorf("error response %s reveals bank host %s", body, host)
+	}
+}
+
+func TestHandleSubmitCardUnknownToken(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess)
+	code, body := post(t, e.handler.HandleSubmitCard, cardForm("0000", ""), nil)
+	if code != http.StatusConflict {
+		t.Fatalf("submit card = %d %s", code, body)
+	}
+	resp := decodeError(t, body)
+	if resp.Status != pkg.HackResponseStatusAlreadyProcessed || resp.Code != web.CodeSessionNotFound ||
+		resp.Step != pkg.StepSubmitCard || resp.Part != pkg.PartSession {
+		t.Errorf("error response = %+v", resp)
+	}
+}
+
+func TestHandleSubmitCardRejected(t *testing.T) {
+	tests := []struct {
+		scenario string
+		want     pkg.HackResponseStatus
+	}{
+		{mock.ScenarioUnknownPaymentSystem, pkg.HackResponseStatusInvalidCard},
+		{mock.ScenarioCVCRequired, pkg.HackResponseStatusSpecifyCVC},
+		{mock.ScenarioInsufficientFunds, pkg.HackResponseStatusInsufficientFunds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scenario, func(t *testing.T) {
+			e := newHandlerEnv(t, tt.scenario)
+			step1 := e.start(t)
+			var resp pkg.SubmitCardResponse
+			code, body := post(t, e.handler.HandleSubmitCard, cardForm(step1.Token, ""), &resp)
+			if code != http.StatusOK || resp.Status != tt.want {
+				t.Errorf("submit card = %d %s, want %s", code, body, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleConfirmPaymentWrongOTP(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioWrongOTP)
+	step1 := e.start(t)
+	e.submitCard(t, step1.Token)
+	var resp pkg.ConfirmPaymentResponse
+	code, body := post(t, e.handler.HandleConfirmPayment, confirmForm(step1.Token, "000000"), &resp)
+	if code != http.StatusOK || resp.Status != pkg.HackResponseStatusWrongOTP {
+		t.Fatalf("confirm payment = %d %s", code, body)
+	}
+	if resp.CurrentAttempt != 1 || resp.TotalAttempts != 3 {
+		t.Errorf("confirm payment = %v", resp)
+	}
+}
+
+func TestHandleConfirmPaymentOperationCancelled(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioOperationCancelled)
+	step1 := e.start(t)
+	e.submitCard(t, step1.Token)
+	var resp pkg.ConfirmPaymentResponse
+	code, body := post(t, e.handler.HandleConfirmPayment, confirmForm(step1.Token, "000000"), &resp)
+	if code != http.StatusOK || resp.Status != pkg.HackResponseStatusOperationCancelled {
+		t.Errorf("confirm payment = %d %s", code, body)
+	}
+}
+
+func TestHandleInvalidRequests(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess)
+	// card is validated with rules of bank of session
+	step1 := e.start(t)
+	badExpiry := cardForm(step1.Token, "")
+	badExpiry.Set("card-expiry", "12")
+	badChecksum := cardForm(step1.Token, "")
+	badChecksum.Set("card-number", "4111111111111112")
+	badNumber := cardForm(step1.Token, "")
+	badNumber.Set("card-number", "4111")
+	badCVC := cardForm(step1.Token, "12")
+	tests := []struct {
+		name  string
+		h     http.HandlerFunc
+		form  url.Values
+		field string
+		// expected code, any if empty
+		code string
+	}{
+		{"start hack without application", e.handler.HandleStartHack, url.Values{"id": {testIdentity}}, "", ""},
+		{"submit card with invalid expiry", e.handler.HandleSubmitCard, badExpiry, card.FieldExpiry, card.CodeInvalidExpiry},
+		{"submit card with invalid checksum", e.handler.HandleSubmitCard, badChecksum, card.FieldNumber, card.CodeInvalidChecksum},
+		{"submit card with short number", e.handler.HandleSubmitCard, badNumber, card.FieldNumber, card.CodeInvalidNumber},
+		{"submit card with invalid cvc", e.handler.HandleSubmitCard, badCVC, card.FieldCVC, card.CodeInvalidCVC},
+		{"resend code without identity", e.handler.HandleResendCode, url.Values{"app": {testApplication}}, "", ""},
+		{"confirm payment without identity", e.handler.HandleConfirmPayment, url.Values{"app": {testApplication}}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := post(t, tt.h, tt.form, nil)
+			if code != http.StatusBadRequest {
+				t.Fatalf("status = %d %s, want %d", code, body, http.StatusBadRequest)
+			}
+			if resp := decodeError(t, body); resp.Status != pkg.HackResponseStatusInvalidRequest || resp.Code == "" ||
+				resp.Field != tt.field || (tt.code != "" && resp.Code != tt.code) {
+				t.Errorf("error response = %+v", resp)
+			}
+		})
+	}
+}
+
+func TestHandleMethodNotAllowed(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess)
+	w := httptest.NewRecorder()
+	e.handler.HandleStartHack(w, httptest.NewRequest(http.MethodGet, "/api/v1/start-hack", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandleAdminBreakers(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess)
+	e.start(t)
+	r := httptest.NewRequest(http.MethodGet, "/api/admin/breakers", nil)
+	w := httptest.NewRecorder()
+	e.handler.HandleAdminBreakers(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("code = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var resp pkg.InspectBreakersResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if len(resp.Breakers) != 1 || resp.Breakers[0].State != pkg.BreakerClosed || resp.Breakers[0].Requests != 1 {
+		t.Errorf("breakers = %v, want single closed breaker with one request", resp.Breakers)
+	}
+}
+
+func TestHandleStartHackContinuesTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	e := newHandlerEnv(t, mock.ScenarioSuccess, withServiceOptions(
+		pkg.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))))
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(e.startForm().Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	e.handler.HandleStartHack(httptest.NewRecorder(), r)
+
+	for _, span := range recorder.Ended() {
+		if span.Name() != "Step1StartHack" {
+			continue
+		}
+		if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+			span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+			t.Errorf("step span does not continue incoming trace")
+		}
+		return
+	}
+	t.Error("step span is not recorded")
+}
+
+func TestRequestIdInServiceLogs(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSessionExpired)
+	mem := memory.New()
+	logger := &log.Logger{Handler: mem, Level: log.InfoLevel}
+	h := web.RequestId(http.HandlerFunc(e.handler.HandleStartHack))
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(e.startForm().Encode()))
+	r = r.WithContext(log.NewContext(context.Background(), logger))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(web.HeaderRequestId, "app-req-42")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if got := w.Header().Get(web.HeaderRequestId); got != "app-req-42" {
+		t.Errorf("%s = %q, want app-req-42", web.HeaderRequestId, got)
+	}
+	var serviceLines int
+	for _, entry := range mem.Entries {
+		if entry.Fields.Get("request-id") != "app-req-42" {
+			t.Errorf("line %q has request-id %v", entry.Message, entry.Fields.Get("request-id"))
+		}
+		if entry.Fields.Get("operation") != nil && entry.Fields.Get("md-order") != nil {
+			serviceLines++
+		}
+	}
+	if serviceLines == 0 {
+		t.Error("service lines with md-order are not logged")
+	}
+}
+
+func TestRequestIdReplacesInvalid(t *testing.T) {
+	h := web.RequestId(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(web.HeaderRequestId, "bad id\nforged: line")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get(web.HeaderRequestId); got == "" || strings.Contains(got, " ") {
+		t.Errorf("%s = %q, want generated id", web.HeaderRequestId, got)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess)
+	auth := web.NewAuthenticator([]web.ApplicationCredentials{
+		{Application: testApplication, APIKey: "key-1", HMACSecret: "secret-1"},
+		{Application: "otherapp", APIKey: "key-2"},
+		{Application: "oldapp", APIKey: "key-3", Disabled: true},
+	})
+	h := auth.Middleware(http.HandlerFunc(e.handler.HandleStartHack))
+	body := e.startForm().Encode()
+	now := time.Now().Unix()
+	signed := func(timestamp int64) http.Header {
+		header := http.Header{}
+		header.Set(web.HeaderApplication, testApplication)
+		header.Set(web.HeaderTimestamp, fmt.Sprint(timestamp))
+		header.Set(web.HeaderSignature, web.Signature("secret-1", timestamp, http.MethodPost, "/api/v1/start-hack", []byte(body)))
+		return header
+	}
+	apiKey := func(key string) http.Header {
+		header := http.Header{}
+		header.Set(web.HeaderAPIKey, key)
+		return header
+	}
+	replayed := signed(now - 1)
+	tests := []struct {
+		name   string
+		header http.Header
+		code   int
+		error  string
+	}{
+		{"api key", apiKey("key-1"), http.StatusOK, ""},
+		{"no credentials", http.Header{}, http.StatusUnauthorized, web.CodeUnauthenticated},
+		{"wrong api key", apiKey("key-9"), http.StatusUnauthorized, web.CodeUnauthenticated},
+		{"other application", apiKey("key-2"), http.StatusForbidden, web.CodeApplicationMismatch},
+		{"disabled application", apiKey("key-3"), http.StatusForbidden, web.CodeApplicationDisabled},
+		{"signature", signed(now), http.StatusOK, ""},
+		{"first use", replayed, http.StatusOK, ""},
+		{"replayed signature", replayed, http.StatusUnauthorized, web.CodeReplayedRequest},
+		{"expired timestamp", signed(now - 3600), http.StatusUnauthorized, web.CodeRequestExpired},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/start-hack", strings.NewReader(body))
+		r.Header = tt.header.Clone()
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: code = %d, want %d: %s", tt.name, w.Code, tt.code, w.Body.String())
+			continue
+		}
+		if tt.error != "" {
+			if resp := decodeError(t, w.Body.String()); resp.Code != tt.error || resp.Status != pkg.HackResponseStatusUnauthorized {
+				t.Errorf("%s: error = %v, want %s", tt.name, resp, tt.error)
+			}
+		}
+	}
+}
+
+func TestRateLimitPerOrder(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess, withRateLimits(web.RateLimits{
+		pkg.StepStartHack: {Order: web.Limit{Requests: 2, Per: time.Hour}},
+	}))
+	start := func(mdOrder string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(e.startFormOf(mdOrder).Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		e.handler.HandleStartHack(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := start(testMDOrder); w.Code != http.StatusOK {
+			t.Fatalf("request %d: code = %d, want 200: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+	w := start(testMDOrder)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("code = %d, want 429: %s", w.Code, w.Body.String())
+	}
+	if resp := decodeError(t, w.Body.String()); resp.Code != web.CodeRateLimited || resp.Status != pkg.HackResponseStatusRateLimited {
+		t.Errorf("error = %v, want %s", resp, web.CodeRateLimited)
+	}
+	// one request per 30 minutes is replenished
+	if got := w.Header().Get("Retry-After"); got != "1800" {
+		t.Errorf("Retry-After = %q, want 1800", got)
+	}
+	if w = start("0a1b2c3d-0000-4000-8000-000000000002"); w.Code != http.StatusOK {
+		t.Errorf("other order: code = %d, want 200: %s", w.Code, w.Body.String())
+	}
+}
+
+// submitCardWithoutSession starts payment of md-order and submits card without token, acs parameters are returned then
+func (e *handlerEnv) submitCardWithoutSession(t *testing.T, mdOrder string) pkg.SubmitCardResponse {
+	t.Helper()
+	code, body := post(t, e.handler.HandleStartHack, e.startFormOf(mdOrder), nil)
+	if code != http.StatusOK {
+		t.Fatalf("start hack = %d %s", code, body)
+	}
+	form := cardForm("", "")
+	form.Set("md-order", mdOrder)
+	var resp pkg.SubmitCardResponse
+	code, body = post(t, e.handler.HandleSubmitCard, form, &resp)
+	if code != http.StatusOK || resp.Status != pkg.HackResponseStatusOk || resp.ACSRequestId == "" {
+		t.Fatalf("submit card = %d %s", code, body)
+	}
+	return resp
+}
+
+func TestRateLimitResendCodeWithoutSession(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioSuccess, withRateLimits(web.DefaultRateLimits()))
+	acs := e.submitCardWithoutSession(t, testMDOrder)
+	form := url.Values{
+		"app":             {testApplication},
+		"id":              {testIdentity},
+		"acs-req-id":      {acs.ACSRequestId},
+		"acs-session-url": {acs.ACSSessionUrl},
+	}
+	for i := 0; i < 3; i++ {
+		if code, body := post(t, e.handler.HandleResendCode, form, nil); code != http.StatusOK {
+			t.Fatalf("request %d: code = %d, want 200: %s", i+1, code, body)
+		}
+	}
+	code, body := post(t, e.handler.HandleResendCode, form, nil)
+	if code != http.StatusTooManyRequests {
+		t.Fatalf("code = %d, want 429: %s", code, body)
+	}
+	if resp := decodeError(t, body); resp.Code != web.CodeRateLimited {
+		t.Errorf("error = %v, want %s", resp, web.CodeRateLimited)
+	}
+}
+
+func TestRateLimitConfirmPaymentWithoutSession(t *testing.T) {
+	e := newHandlerEnv(t, mock.ScenarioWrongOTP, withRateLimits(web.RateLimits{
+		pkg.StepConfirmPayment: {Order: web.Limit{Requests: 2, Per: time.Hour}},
+	}))
+	acs := e.submitCardWithoutSession(t, testMDOrder)
+	// md-order is not checked by ACS, changing it must not reset the limit
+	confirm := func(mdOrder string) (int, string) {
+		return post(t, e.handler.HandleConfirmPayment, url.Values{
+			"app":             {testApplication},
+			"id":              {testIdentity},
+			"md-order":        {mdOrder},
+			"acs-req-id":      {acs.ACSRequestId},
+			"acs-session-url": {acs.ACSSessionUrl},
+			"otp":             {"000000"},
+			"term-url":        {acs.TerminateUrl},
+		}, nil)
+	}
+	for i, mdOrder := range []string{testMDOrder, "0a1b2c3d-0000-4000-8000-000000000002"} {
+		if code, body := confirm(mdOrder); code != http.StatusOK {
+			t.Fatalf("request %d: code = %d, want 200: %s", i+1, code, body)
+		}
+	}
+	code, body := confirm("0a1b2c3d-0000-4000-8000-000000000003")
+	if code != http.StatusTooManyRequests {
+		t.Fatalf("code = %d, want 429: %s", code, body)
+	}
+	if resp := decodeError(t, body); resp.Code != web.CodeRateLimited {
+		t.Errorf("error = %v, want %s", resp, web.CodeRateLimited)
+	}
+}
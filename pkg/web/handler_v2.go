@@ -0,0 +1,66 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"ykjam/bpchack/pkg"
+)
+
+// maxJSONBodySize limits size of v2 request bodies
+const maxJSONBodySize = 64 << 10
+
+var ErrNotJSON = errors.New("request content type is not application/json")
+
+// decodeJSON reads json request body into v
+func decodeJSON(r *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return ErrNotJSON
+	}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxJSONBodySize))
+	err = decoder.Decode(v)
+	if err != nil {
+		return errors.Wrap(err, "error decoding json body")
+	}
+	return nil
+}
+
+func (c *handlerContext) HandleStartHackV2(w http.ResponseWriter, r *http.Request) {
+	c.handleStartHack("handleStartHackV2", w, r, func(r *http.Request) (req pkg.StartHackRequest, err error) {
+		err = decodeJSON(r, &req)
+		return
+	})
+}
+
+func (c *handlerContext) HandleSubmitCardV2(w http.ResponseWriter, r *http.Request) {
+	c.handleSubmitCard("handleSubmitCardV2", w, r, func(r *http.Request) (req pkg.SubmitCardRequest, err error) {
+		err = decodeJSON(r, &req)
+		return
+	})
+}
+
+func (c *handlerContext) HandleResendCodeV2(w http.ResponseWriter, r *http.Request) {
+	c.handleResendCode("handleResendCodeV2", w, r, func(r *http.Request) (req pkg.ResendCodeRequest, err error) {
+		err = decodeJSON(r, &req)
+		return
+	})
+}
+
+func (c *handlerContext) HandleConfirmPaymentV2(w http.ResponseWriter, r *http.Request) {
+	c.handleConfirmPayment("handleConfirmPaymentV2", w, r, func(r *http.Request) (req pkg.ConfirmPaymentRequest, err error) {
+		err = decodeJSON(r, &req)
+		return
+	})
+}
+
+func (c *handlerContext) HandleOrderStatusV2(w http.ResponseWriter, r *http.Request) {
+	c.handleOrderStatus("handleOrderStatusV2", w, r, func(r *http.Request) (req pkg.OrderStatusRequest, err error) {
+		err = decodeJSON(r, &req)
+		return
+	})
+}
@@ -0,0 +1,209 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+
+	"ykjam/bpchack/pkg"
+)
+
+// Limit lets Requests through per Per duration, with bursts of up to Burst requests,
+// zero Requests means no limit
+type Limit struct {
+	Requests int
+	Per      time.Duration
+	// Requests if zero
+	Burst int
+}
+
+func (l Limit) enabled() bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+// EndpointLimits limit requests to endpoint of a single application, identity and order
+type EndpointLimits struct {
+	Application Limit
+	Identity    Limit
+	// order is md-order of session or request, acs request id for one-time password steps without session
+	Order Limit
+}
+
+// RateLimits are limits of workflow endpoints by step, v1 and v2 endpoints of step share limits
+type RateLimits map[pkg.Step]EndpointLimits
+
+// DefaultRateLimits limit attempts of a single payment to send and check one-time password,
+// which burn attempts given by bank
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		pkg.StepResendCode:     {Order: Limit{Requests: 3, Per: 10 * time.Minute}},
+		pkg.StepConfirmPayment: {Order: Limit{Requests: 5, Per: 10 * time.Minute}},
+	}
+}
+
+type RateLimiter interface {
+	// Allow takes a token from every bucket of request, if all of them have one,
+	// otherwise it returns scope exceeded and time after which request may be retried
+	Allow(step pkg.Step, application, identity, order string) (ok bool, scope string, retryAfter time.Duration)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// tokens per second
+	rate  float64
+	burst float64
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+type rateLimiter struct {
+	limits RateLimits
+	now    func() time.Time
+
+	mu         sync.Mutex
+	buckets    map[string]*bucket
+	lastPruned time.Time
+}
+
+func NewRateLimiter(limits RateLimits) RateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *rateLimiter) Allow(step pkg.Step, application, identity, order string) (ok bool, scope string, retryAfter time.Duration) {
+	limits, found := l.limits[step]
+	if !found {
+		return true, "", 0
+	}
+	scopes := []struct {
+		name  string
+		key   string
+		limit Limit
+	}{
+		{"application", application, limits.Application},
+		{"identity", application + "/" + identity, limits.Identity},
+		{"order", order, limits.Order},
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+	taken := make([]*bucket, 0, len(scopes))
+	for _, s := range scopes {
+		if !s.limit.enabled() || s.key == "" {
+			continue
+		}
+		b := l.bucket(fmt.Sprintf("%s|%s|%s", step, s.name, s.key), s.limit, now)
+		b.refill(now)
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+			return false, s.name, wait
+		}
+		taken = append(taken, b)
+	}
+	for _, b := range taken {
+		b.tokens--
+	}
+	return true, "", 0
+}
+
+func (l *rateLimiter) bucket(key string, limit Limit, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		burst := limit.Burst
+		if burst <= 0 {
+			burst = limit.Requests
+		}
+		b = &bucket{
+			tokens: float64(burst),
+			last:   now,
+			rate:   float64(limit.Requests) / limit.Per.Seconds(),
+			burst:  float64(burst),
+		}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// prune forgets buckets which are full again, they are the same as new ones
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPruned) < time.Minute {
+		return
+	}
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPruned = now
+}
+
+// mdOrderOf returns md-order of payment url, if any
+func mdOrderOf(paymentUrl string) string {
+	u, err := url.Parse(paymentUrl)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("mdOrder")
+}
+
+// orderOf returns md-order of session, so new sessions of the same order share its limit,
+// key given is used by requests without token: md-order, or acs request id for one-time password steps.
+// ACS counts password attempts by its request id, while md-order is not checked by it and can be changed freely
+func (c *handlerContext) orderOf(ctx context.Context, application, identity, token, key string) string {
+	if token == "" {
+		if key == "" {
+			// scopes without key are not limited, requests missing it share one bucket
+			return "-"
+		}
+		return key
+	}
+	resp, err := c.service.InspectSession(ctx, pkg.InspectSessionRequest{
+		Application: application,
+		Identity:    identity,
+		Token:       token,
+	})
+	if err != nil || resp.MDOrder == "" {
+		// service refuses request without session anyway
+		return token
+	}
+	return resp.MDOrder
+}
+
+// allowed checks rate limits of request and responds with 429 if any is exceeded
+func (c *handlerContext) allowed(ctx context.Context, clog *log.Entry, w http.ResponseWriter, step pkg.Step, application, identity, token, orderKey string) bool {
+	if c.limiter == nil {
+		return true
+	}
+	order := c.orderOf(ctx, application, identity, token, orderKey)
+	ok, scope, retryAfter := c.limiter.Allow(step, application, identity, order)
+	if ok {
+		return true
+	}
+	clog.WithFields(log.Fields{
+		"scope":       scope,
+		"retry-after": retryAfter,
+	}).Warn("rate limit exceeded")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	errorResponse(ctx, clog, w, http.StatusTooManyRequests, ErrorResponse{
+		Status:  pkg.HackResponseStatusRateLimited,
+		Code:    CodeRateLimited,
+		Message: fmt.Sprintf("too many requests per %s", scope),
+	})
+	return false
+}
@@ -0,0 +1,60 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/apex/log"
+)
+
+// HeaderRequestId is accepted from clients and echoed in every response
+const HeaderRequestId = "X-Request-ID"
+
+// incoming request ids not matching are replaced, so they are safe to log
+var rRequestId = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+type requestIdKey struct{}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func withRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+func requestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// requestContext takes request id of client or generates one, echoes it in response
+// and returns context holding it together with log entry of request,
+// which service uses for its log lines
+func requestContext(w http.ResponseWriter, r *http.Request) context.Context {
+	ctx := r.Context()
+	if requestIdFromContext(ctx) != "" {
+		return ctx
+	}
+	requestId := r.Header.Get(HeaderRequestId)
+	if !rRequestId.MatchString(requestId) {
+		requestId = newRequestId()
+	}
+	w.Header().Set(HeaderRequestId, requestId)
+	ctx = withRequestId(ctx, requestId)
+	return log.NewContext(ctx, log.FromContext(ctx).WithField("request-id", requestId))
+}
+
+// RequestId is middleware assigning request id to every request
+func RequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(requestContext(w, r)))
+	})
+}